@@ -30,6 +30,13 @@
           go build -o $out/share/xk/userscripts/genrefs ./src/userscripts-go/cmd/genrefs
           go build -o $out/share/xk/userscripts/gencards ./src/userscripts-go/cmd/gencards
           go build -o $out/share/xk/userscripts/syncanki ./src/userscripts-go/cmd/syncanki
+          go build -o $out/share/xk/userscripts/backlinks ./src/userscripts-go/cmd/backlinks
+          go build -o $out/share/xk/userscripts/graph ./src/userscripts-go/cmd/graph
+          go build -o $out/share/xk/userscripts/doctor ./src/userscripts-go/cmd/doctor
+          go build -o $out/share/xk/userscripts/search ./src/userscripts-go/cmd/search
+          go build -o $out/share/xk/userscripts/lsp ./src/userscripts-go/cmd/lsp
+          go build -o $out/share/xk/userscripts/xkd ./src/userscripts-go/cmd/xkd
+          go build -o $out/share/xk/userscripts/cache ./src/userscripts-go/cmd/cache
         '';
 
         installPhase = ''
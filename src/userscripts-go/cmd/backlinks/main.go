@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+func main() {
+	zettelName := flag.String("z", "", "Name of the Zettel to update (or list) backlinks for")
+	list := flag.Bool("ls", false, "Print the backlinks of the Zettel given with -z instead of updating them")
+	flag.Parse()
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	// Query mode: print the stored backlinks
+	if *list {
+		if *zettelName == "" {
+			log.Fatal("You must provide a Zettel name using the -z option.")
+		}
+		if _, err := k.Path(*zettelName); err != nil {
+			log.Fatal(err)
+		}
+		links, err := k.Backlinks(*zettelName)
+		if err != nil {
+			log.Fatalf("Error reading backlinks: %v", err)
+		}
+		for _, link := range links {
+			fmt.Println(link)
+		}
+		return
+	}
+
+	// Incremental mode: only touch the zettels whose backlinks to -z changed
+	if *zettelName != "" {
+		if _, err := k.Path(*zettelName); err != nil {
+			log.Fatal(err)
+		}
+		oldRefs, err := k.AppliedRefs(*zettelName)
+		if err != nil {
+			log.Fatalf("Error reading previous references: %v", err)
+		}
+		newRefs, err := k.Refs(*zettelName)
+		if err != nil {
+			log.Fatalf("Error reading references: %v", err)
+		}
+		rewritten, err := k.UpdateBacklinks(*zettelName, oldRefs, newRefs)
+		for _, z := range rewritten {
+			log.Printf("Updated backlinks of %s", z)
+		}
+		if err != nil {
+			log.Fatalf("Error updating backlinks: %v", err)
+		}
+		return
+	}
+
+	// Full rebuild: invert every references file
+	index, err := k.BuildBacklinks()
+	if err != nil {
+		log.Fatalf("Error building backlinks: %v", err)
+	}
+	if err := k.ForgetAppliedRefs(); err != nil {
+		log.Fatalf("Error resetting recorded references: %v", err)
+	}
+
+	failed := false
+	for z, links := range index {
+		changed, err := k.WriteBacklinks(z, links)
+		if err != nil {
+			log.Printf("Error writing backlinks of %s: %v", z, err)
+			failed = true
+			continue
+		}
+		if changed {
+			log.Printf("Updated backlinks of %s", z)
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
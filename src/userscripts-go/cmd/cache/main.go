@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s rebuild|verify\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  rebuild  discard the parse cache and parse every zettel")
+		fmt.Fprintln(flag.CommandLine.Output(), "  verify   reparse every zettel and compare the result with the cache")
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	parseCache, err := cache.Open(k)
+	if err != nil {
+		log.Fatalf("Error opening parse cache: %v", err)
+	}
+
+	parser, err := cache.NewParser(sitter.NewLanguage(treesitter.Language()))
+	if err != nil {
+		log.Fatalf("Error compiling reference query: %v", err)
+	}
+	defer parser.Close()
+
+	zettels, err := k.List()
+	if err != nil {
+		log.Fatalf("Error listing zettels: %v", err)
+	}
+
+	switch flag.Arg(0) {
+	case "rebuild":
+		parseCache.Clear()
+		failed := 0
+		for _, z := range zettels {
+			if _, err := parseCache.Entry(parser, z); err != nil {
+				log.Printf("%s: %v", z, err)
+				failed++
+			}
+		}
+		if err := parseCache.Save(); err != nil {
+			log.Fatalf("Error saving parse cache: %v", err)
+		}
+		fmt.Printf("Cached %d zettels, %d failed\n", len(zettels)-failed, failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+
+	case "verify":
+		mismatches := 0
+		for _, problem := range verify(k, parseCache, parser, zettels) {
+			fmt.Println(problem)
+			if problem.mismatch {
+				mismatches++
+			}
+		}
+		if mismatches > 0 {
+			fmt.Printf("%d cache entries disagree with their zettel, run cache rebuild\n", mismatches)
+			os.Exit(1)
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// problem is a finding of verify. Missing and outdated entries are expected
+// and refreshed on the next run, only mismatches point at a broken cache.
+type problem struct {
+	path     string
+	message  string
+	mismatch bool
+}
+
+func (p problem) String() string {
+	return fmt.Sprintf("%s: %s", p.path, p.message)
+}
+
+// verify compares every cache entry with a fresh parse of its zettel without modifying the cache
+func verify(k *kasten.Kasten, c *cache.Cache, parser *cache.Parser, zettels []string) []problem {
+	var problems []problem
+	present := map[string]bool{}
+
+	for _, z := range zettels {
+		cached := c.Cached(z)
+		if cached == nil {
+			problems = append(problems, problem{z, "not cached", false})
+			continue
+		}
+		present[cached.Path] = true
+
+		source, err := os.ReadFile(k.File(z, k.ZettelFilename))
+		if err != nil {
+			problems = append(problems, problem{cached.Path, err.Error(), false})
+			continue
+		}
+		if cache.HashBytes(source) != cached.Source.Hash {
+			problems = append(problems, problem{cached.Path, "outdated, the zettel changed since it was cached", false})
+			continue
+		}
+
+		fresh := parser.Parse(z, source)
+		if fresh.Config != cached.Config {
+			problems = append(problems, problem{cached.Path, "outdated, the reference configuration changed", false})
+			continue
+		}
+
+		tagFile, err := os.ReadFile(k.File(z, k.TagFilename))
+		if err != nil && !os.IsNotExist(err) {
+			problems = append(problems, problem{cached.Path, err.Error(), false})
+			continue
+		}
+		if (err == nil) != (cached.TagFile.Hash != "") || err == nil && cache.HashBytes(tagFile) != cached.TagFile.Hash {
+			problems = append(problems, problem{cached.Path, "outdated, the tags changed since they were cached", false})
+			continue
+		}
+		tags := kasten.ParseLines(tagFile)
+
+		mismatch := func(field string) {
+			problems = append(problems, problem{cached.Path, field + " differ from the zettel", true})
+		}
+		if !equal(fresh.Occurrences, cached.Occurrences) {
+			mismatch("references")
+		}
+		if !equal(fresh.Cards, cached.Cards) || !equal(fresh.Malformed, cached.Malformed) {
+			mismatch("flashcards")
+		}
+		if !equal(fresh.Labels, cached.Labels) {
+			mismatch("labels")
+		}
+		if !equal(tags, cached.Tags) {
+			mismatch("tags")
+		}
+		if fresh.Title != cached.Title || fresh.SyntaxErrors != cached.SyntaxErrors {
+			mismatch("metadata")
+		}
+	}
+
+	for _, path := range c.Paths() {
+		if !present[path] {
+			problems = append(problems, problem{path, "cached, but the zettel no longer exists", false})
+		}
+	}
+
+	return problems
+}
+
+// equal compares two lists, treating nil and empty lists alike as the cache file does
+func equal[T any](a, b []T) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/references"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Issue is a single finding of the doctor
+type Issue struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Zettel   string `json:"zettel"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Message  string `json:"message"`
+}
+
+// String formats the issue like a compiler diagnostic
+func (i Issue) String() string {
+	location := i.Zettel
+	if i.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", i.Zettel, i.Line, i.Column)
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", location, i.Severity, i.Message, i.Check)
+}
+
+// cardFilePattern matches the files generated by gencards, the LaTeX sides and their HTML translations
+var cardFilePattern = regexp.MustCompile(`^card_(.+)_(front|back)\.(tex|html)$`)
+
+// clozeFilePattern matches the files generated by gencards for the deletions of cloze cards
+var clozeFilePattern = regexp.MustCompile(`^cloze_(.+)_[0-9]+_(front|back)\.(tex|html)$`)
+
+// cardLocation remembers where a flashcard id was defined
+type cardLocation struct {
+	zettel string
+	point  sitter.Point
+}
+
+// Doctor audits a whole kasten
+type Doctor struct {
+	kasten *kasten.Kasten
+	parser *sitter.Parser
+	refs   *references.Extractor
+	issues []Issue
+	ids    map[string][]cardLocation
+}
+
+func (d *Doctor) report(severity, check, zettel string, point *sitter.Point, format string, args ...any) {
+	issue := Issue{
+		Severity: severity,
+		Check:    check,
+		Zettel:   zettel,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if point != nil {
+		issue.Line = int(point.Row) + 1
+		issue.Column = int(point.Column) + 1
+	}
+	d.issues = append(d.issues, issue)
+}
+
+// Run performs all checks and returns the issues sorted by zettel and position.
+func (d *Doctor) Run() ([]Issue, error) {
+	zettels, err := d.kasten.List()
+	if err != nil {
+		return nil, err
+	}
+
+	d.ids = map[string][]cardLocation{}
+	incoming := map[string]int{}
+	outgoing := map[string]int{}
+
+	for _, z := range zettels {
+		refs, err := d.kasten.Refs(z)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read references of %s: %v", z, err)
+		}
+
+		for _, ref := range refs {
+			if !d.kasten.Exists(ref) {
+				d.report(SeverityError, "broken-reference", z, nil,
+					"reference to missing zettel %s", ref)
+				continue
+			}
+			if ref != z {
+				outgoing[z]++
+				incoming[ref]++
+			}
+		}
+
+		if err := d.checkZettel(z, refs); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, z := range zettels {
+		if incoming[z] == 0 && outgoing[z] == 0 {
+			d.report(SeverityWarning, "orphan", z, nil,
+				"zettel neither references nor is referenced by another zettel")
+		}
+	}
+
+	for id, locations := range d.ids {
+		if len(locations) < 2 {
+			continue
+		}
+		for _, loc := range locations {
+			var others []string
+			for _, other := range locations {
+				if other != loc {
+					others = append(others, fmt.Sprintf("%s:%d", other.zettel, other.point.Row+1))
+				}
+			}
+			point := loc.point
+			d.report(SeverityError, "duplicate-flashcard-id", loc.zettel, &point,
+				"flashcard id %s is also used in %s", id, strings.Join(others, ", "))
+		}
+	}
+
+	sort.SliceStable(d.issues, func(i, j int) bool {
+		a, b := d.issues[i], d.issues[j]
+		if a.Zettel != b.Zettel {
+			return a.Zettel < b.Zettel
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	return d.issues, nil
+}
+
+// checkZettel parses a single zettel and runs the per-file checks
+func (d *Doctor) checkZettel(z string, refs []string) error {
+	source, err := os.ReadFile(d.kasten.File(z, d.kasten.ZettelFilename))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", z, err)
+	}
+
+	tree := d.parser.Parse(nil, source)
+	defer tree.Close()
+	root := tree.RootNode()
+
+	// syntax errors
+	for _, node := range treesitter.FindErrors(root) {
+		point := node.StartPoint()
+		if node.IsMissing() {
+			d.report(SeverityError, "syntax", z, &point, "missing %s", node.Type())
+		} else {
+			d.report(SeverityError, "syntax", z, &point, "syntax error")
+		}
+	}
+
+	// drift between citations and the references file
+	cited := map[string]bool{}
+	for _, ref := range d.refs.Extract(root, source) {
+		cited[ref] = true
+		if !d.kasten.Exists(ref) {
+			d.report(SeverityError, "broken-citation", z, nil, "citation of missing zettel %s", ref)
+			continue
+		}
+		if !contains(refs, ref) {
+			d.report(SeverityWarning, "citation-drift", z, nil,
+				"%s is cited but missing from %s (run genrefs)", ref, d.kasten.ReferenceFilename)
+		}
+	}
+	for _, ref := range refs {
+		if d.kasten.Exists(ref) && !cited[ref] {
+			d.report(SeverityWarning, "citation-drift", z, nil,
+				"%s is listed in %s but never cited", ref, d.kasten.ReferenceFilename)
+		}
+	}
+
+	// flashcards
+	sourceIDs := map[string]bool{}
+	for _, env := range treesitter.FindGenericEnvironment(root, source, "flashcard") {
+		point := env.EnvironmentNode.StartPoint()
+		card, err := flashcard.EnvToFlashcard(env, source)
+		if err != nil {
+			d.report(SeverityError, "malformed-flashcard", z, &point, "%v", err)
+			continue
+		}
+		if !flashcard.IDPattern.MatchString(card.ID) {
+			d.report(SeverityError, "malformed-flashcard", z, &point,
+				"flashcard id %q must match %s", card.ID, flashcard.IDPattern)
+			continue
+		}
+		sourceIDs[card.ID] = true
+		d.ids[card.ID] = append(d.ids[card.ID], cardLocation{z, point})
+	}
+
+	// cloze cards share the id namespace with flashcards
+	clozeIDs := map[string]bool{}
+	for _, env := range treesitter.FindGenericEnvironment(root, source, "clozecard") {
+		point := env.EnvironmentNode.StartPoint()
+		card, err := flashcard.EnvToClozeCard(env, source)
+		if err != nil {
+			d.report(SeverityError, "malformed-flashcard", z, &point, "%v", err)
+			continue
+		}
+		if !flashcard.IDPattern.MatchString(card.ID) {
+			d.report(SeverityError, "malformed-flashcard", z, &point,
+				"cloze card id %q must match %s", card.ID, flashcard.IDPattern)
+			continue
+		}
+		clozeIDs[card.ID] = true
+		d.ids[card.ID] = append(d.ids[card.ID], cardLocation{z, point})
+	}
+
+	// generated files without a source and unresolved fixmes
+	dir := d.kasten.Dir(z)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if m := cardFilePattern.FindStringSubmatch(name); m != nil && !sourceIDs[m[1]] {
+			d.report(SeverityError, "orphan-card-file", z, nil,
+				"%s has no flashcard environment with id %s", filepath.Join(z, name), m[1])
+		}
+		if m := clozeFilePattern.FindStringSubmatch(name); m != nil && !clozeIDs[m[1]] {
+			d.report(SeverityError, "orphan-card-file", z, nil,
+				"%s has no clozecard environment with id %s", filepath.Join(z, name), m[1])
+		}
+		if id, ok := strings.CutPrefix(name, "fix_"); ok {
+			d.report(SeverityWarning, "unresolved-fix", z, nil,
+				"flashcard %s has an unresolved fixme (%s)", id, filepath.Join(z, name))
+		}
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
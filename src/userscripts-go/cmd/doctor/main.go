@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/references"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+func main() {
+	asJSON := flag.Bool("json", false, "Print the report as JSON")
+	strict := flag.Bool("strict", false, "Exit non-zero on warnings as well as errors")
+	flag.Parse()
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	// Initialize the parser for LaTeX
+	parser := sitter.NewParser()
+	defer parser.Close()
+	lang := sitter.NewLanguage(treesitter.Language())
+	parser.SetLanguage(lang)
+
+	extractor, err := references.NewExtractor(lang)
+	if err != nil {
+		log.Fatalf("Error compiling reference query: %v", err)
+	}
+	defer extractor.Close()
+
+	doctor := Doctor{kasten: k, parser: parser, refs: extractor}
+	issues, err := doctor.Run()
+	if err != nil {
+		log.Fatalf("Error checking kasten: %v", err)
+	}
+
+	errors, warnings := 0, 0
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	if *asJSON {
+		report := struct {
+			Issues   []Issue `json:"issues"`
+			Errors   int     `json:"errors"`
+			Warnings int     `json:"warnings"`
+		}{append([]Issue{}, issues...), errors, warnings}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("Error writing report: %v", err)
+		}
+	} else {
+		for _, issue := range issues {
+			fmt.Println(issue)
+		}
+		fmt.Printf("%d errors, %d warnings\n", errors, warnings)
+	}
+
+	if errors > 0 || (*strict && warnings > 0) {
+		os.Exit(1)
+	}
+}
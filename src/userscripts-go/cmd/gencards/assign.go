@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// idAlphabet and idLength describe generated card ids, they match flashcard.IDPattern
+const (
+	idAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+	idLength   = 8
+)
+
+// cardEnvironments are the environments identified by an [id] right after their name
+var cardEnvironments = []string{"flashcard", "clozecard"}
+
+// insertion is an id to be written into the source at a byte offset
+type insertion struct {
+	offset uint32
+	id     string
+}
+
+// NewID returns a random id that is not in taken and adds it to taken.
+func NewID(taken map[string]bool) (string, error) {
+	size := big.NewInt(int64(len(idAlphabet)))
+	for {
+		id := make([]byte, idLength)
+		for i := range id {
+			n, err := rand.Int(rand.Reader, size)
+			if err != nil {
+				return "", err
+			}
+			id[i] = idAlphabet[n.Int64()]
+		}
+		if !taken[string(id)] {
+			taken[string(id)] = true
+			return string(id), nil
+		}
+	}
+}
+
+// TakenIDs collects the ids of the flashcards and cloze cards anywhere in the kasten
+func TakenIDs(k *kasten.Kasten, c *cache.Cache, p *cache.Parser) (map[string]bool, error) {
+	zettels, err := k.List()
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[string]bool{}
+	for _, z := range zettels {
+		entry, err := c.Entry(p, z)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range entry.CardIDs() {
+			taken[id] = true
+		}
+	}
+	return taken, nil
+}
+
+// AssignIDs inserts an [id] into every card environment of the source that has none.
+// Only the ids are inserted, all other bytes and existing ids stay as they are.
+// It returns the new source and the assigned ids.
+func AssignIDs(root *sitter.Node, source []byte, taken map[string]bool) ([]byte, []string, error) {
+	var insertions []insertion
+	for _, name := range cardEnvironments {
+		for _, env := range treesitter.FindGenericEnvironment(root, source, name) {
+			if len(env.ArgumentNodes) > 0 && env.ArgumentNodes[0].Type() == "brack_group" {
+				// ids of this zettel may not be in the cache yet, e.g. if they are malformed
+				idNode := env.ArgumentNodes[0]
+				taken[string(source[idNode.StartByte()+1:idNode.EndByte()-1])] = true
+				continue
+			}
+			begin := env.EnvironmentNode.ChildByFieldName("begin")
+			nameNode := begin.Child(0).NextSibling()
+			insertions = append(insertions, insertion{offset: nameNode.EndByte()})
+		}
+	}
+	if len(insertions) == 0 {
+		return source, nil, nil
+	}
+
+	// ids are assigned in order of appearance
+	sort.Slice(insertions, func(i, j int) bool { return insertions[i].offset < insertions[j].offset })
+	var ids []string
+	for i := range insertions {
+		id, err := NewID(taken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate id: %v", err)
+		}
+		insertions[i].id = id
+		ids = append(ids, id)
+	}
+
+	var result []byte
+	last := uint32(0)
+	for _, ins := range insertions {
+		result = append(result, source[last:ins.offset]...)
+		result = append(result, "["+ins.id+"]"...)
+		last = ins.offset
+	}
+	result = append(result, source[last:]...)
+
+	return result, ids, nil
+}
+
+// WriteAtomically replaces the content of a file, keeping its permissions
+func WriteAtomically(path string, content []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".zettel-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// assignIDs writes ids for all card environments without one into the zettel file
+// and prints the new ids
+func assignIDs(k *kasten.Kasten, c *cache.Cache, p *cache.Parser, lang *sitter.Language, texFilePath string) error {
+	taken, err := TakenIDs(k, c, p)
+	if err != nil {
+		return err
+	}
+
+	source, err := os.ReadFile(texFilePath)
+	if err != nil {
+		return err
+	}
+
+	parser := sitter.NewParser()
+	defer parser.Close()
+	parser.SetLanguage(lang)
+	tree := parser.Parse(nil, source)
+	defer tree.Close()
+
+	updated, ids, err := AssignIDs(tree.RootNode(), source, taken)
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		log.Println("All cards have an id.")
+		return nil
+	}
+
+	if err := WriteAtomically(texFilePath, updated); err != nil {
+		return err
+	}
+	log.Printf("Assigned ids %v to cards in %s", ids, texFilePath)
+	for _, id := range ids {
+		fmt.Println(id)
+	}
+	return nil
+}
@@ -1,75 +1,174 @@
 package main
 
 import (
+	"errors"
 	"flag"
-	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
-	"xk/src/userscripts-go/pkg/api"
+	"reflect"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
 	"xk/src/userscripts-go/pkg/logging"
 	"xk/src/userscripts-go/pkg/treesitter"
 
 	sitter "github.com/smacker/go-tree-sitter"
 )
 
-type FlashCard struct {
-	id    string
-	front string
-	back  string
-}
-
-// EnvToFlashcard extracts flashcards from the form
-// \begin{flashcard}[<id>]{<question>} <content> \end{flashcard}
-func EnvToFlashcard(env treesitter.GenericEnvironment, source []byte) (FlashCard, error) {
-	// get id
-	idNode := env.ArgumentNodes[0]
-	if idNode.Type() != "brack_group" {
-		return FlashCard{"", "", ""}, fmt.Errorf("flashcard is malformatted")
+// RemoveObsoleteFiles removes the card files of the previous manifest that the
+// current one no longer lists. Without a previous manifest, i.e. for zettels
+// processed before manifests existed, files named like card files are candidates.
+func RemoveObsoleteFiles(previous *flashcard.Manifest, current flashcard.Manifest, zettelDir string) error {
+	valid := make(map[string]bool)
+	for _, name := range current.Files() {
+		valid[name] = true
 	}
-	id := string(source[idNode.StartByte()+1 : idNode.EndByte()-1])
 
-	// get front
-	frontNode := env.EnvironmentNode.Child(0).NextSibling()
-	if frontNode.Type() != "curly_group" {
-		return FlashCard{"", "", ""}, fmt.Errorf("flashcard is malformatted")
+	var candidates []string
+	if previous != nil {
+		candidates = previous.Files()
+	} else {
+		for _, pattern := range []string{"card_*_*.tex", "cloze_*_*_*.tex"} {
+			files, err := filepath.Glob(filepath.Join(zettelDir, pattern))
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				candidates = append(candidates, filepath.Base(file))
+			}
+		}
 	}
-	front := string(source[frontNode.StartByte()+1 : frontNode.EndByte()-1])
 
-	// get back
-	back := env.EnvironmentNode.Content(source)
+	for _, name := range candidates {
+		// never follow a manifest out of the zettel directory
+		if valid[name] || name != filepath.Base(name) {
+			continue
+		}
+		file := filepath.Join(zettelDir, name)
+		log.Println("Removing obsolete file:", file)
+		err := os.Remove(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error removing file %s: %v", file, err)
+			return err
+		}
+	}
 
-	return FlashCard{id, front, back}, nil
+	return nil
 }
 
-// CheckAndRemoveObsoleteFiles removes files with IDs not matching the extracted ones
-func CheckAndRemoveObsoleteFiles(validIDs map[string]bool, zettelDir string) error {
-	// Get all files in the zettel directory matching the pattern
-	files, err := filepath.Glob(filepath.Join(zettelDir, "card_*_*.tex"))
-	if err != nil {
-		return err
+// CardFilesCurrent reports whether the manifest describes exactly the cards of
+// the cached entry and the card files have matching content.
+func CardFilesCurrent(entry *cache.Entry, manifest *flashcard.Manifest, zettelDir string) bool {
+	if manifest == nil {
+		return len(entry.Cards) == 0
+	}
+	if len(manifest.Cards) != len(entry.Cards) {
+		return false
 	}
 
-	for _, file := range files {
-		parts := strings.Split(file, "_")
-		if len(parts) < 3 {
-			continue
+	for i, card := range entry.Cards {
+		listed := manifest.Cards[i]
+		if listed.ID != card.ID || listed.Kind != card.Kind || listed.Hash != card.Hash ||
+			listed.Start != card.Start || listed.End != card.End ||
+			!reflect.DeepEqual(listed.Files, card.Files()) {
+			return false
 		}
 
-		id := parts[1]
-		if !validIDs[id] {
-			log.Println("Removing obsolete file:", file)
-			err := os.Remove(file)
+		var fronts, backs [][]byte
+		for _, files := range listed.Files {
+			front, err := ioutil.ReadFile(filepath.Join(zettelDir, files.Front))
 			if err != nil {
-				log.Printf("Error removing file %s: %v", file, err)
-				return err
+				return false
+			}
+			back, err := ioutil.ReadFile(filepath.Join(zettelDir, files.Back))
+			if err != nil {
+				return false
+			}
+			fronts = append(fronts, front)
+			backs = append(backs, back)
+		}
+		if flashcard.HashSides(fronts, backs) != card.Hash {
+			return false
+		}
+
+		for _, files := range listed.HTML {
+			for _, name := range []string{files.Front, files.Back} {
+				if _, err := os.Stat(filepath.Join(zettelDir, name)); err != nil {
+					return false
+				}
 			}
 		}
 	}
 
-	return nil
+	return true
+}
+
+// RenderedCard is a card of the zettel with the content of its files
+type RenderedCard struct {
+	Manifest   flashcard.ManifestCard
+	Fronts     []string
+	Backs      []string
+	HTMLFronts []string
+	HTMLBacks  []string
+}
+
+// RenderCard wraps the sides of a card into standalone documents and describes the card for the manifest
+func RenderCard(kind, id string, env treesitter.GenericEnvironment, preamble string, fronts, backs []string) RenderedCard {
+	card := RenderedCard{
+		Manifest: flashcard.ManifestCard{
+			ID:    id,
+			Kind:  kind,
+			Start: env.EnvironmentNode.StartByte(),
+			End:   env.EnvironmentNode.EndByte(),
+			Files: flashcard.Files(kind, id, len(fronts)),
+		},
+	}
+
+	var frontBytes, backBytes [][]byte
+	for i := range fronts {
+		card.Fronts = append(card.Fronts, flashcard.Render(preamble, fronts[i]))
+		card.Backs = append(card.Backs, flashcard.Render(preamble, backs[i]))
+		frontBytes = append(frontBytes, []byte(card.Fronts[i]))
+		backBytes = append(backBytes, []byte(card.Backs[i]))
+	}
+	card.Manifest.Hash = flashcard.HashSides(frontBytes, backBytes)
+
+	return card
+}
+
+// TranslateCard translates the sides of a card to HTML, unless the card asks
+// to be rendered as SVG. A card with a construct that has no HTML translation
+// only keeps its LaTeX files, syncanki then falls back to SVG.
+func TranslateCard(card *RenderedCard, parser *sitter.Parser, opts treesitter.HTMLOptions, fronts, backs []string) {
+	if card.Manifest.Render == flashcard.RenderSVG {
+		return
+	}
+
+	translate := func(side string) (string, error) {
+		source := []byte(side)
+		tree := parser.Parse(nil, source)
+		defer tree.Close()
+		return treesitter.HTML(tree.RootNode(), source, opts)
+	}
+
+	var htmlFronts, htmlBacks []string
+	for i := range fronts {
+		front, err := translate(fronts[i])
+		if err == nil {
+			var back string
+			back, err = translate(backs[i])
+			htmlFronts, htmlBacks = append(htmlFronts, front), append(htmlBacks, back)
+		}
+		if err != nil {
+			log.Printf("Card %s is rendered as SVG: %v", card.Manifest.ID, err)
+			return
+		}
+	}
+
+	card.HTMLFronts, card.HTMLBacks = htmlFronts, htmlBacks
+	card.Manifest.HTML = flashcard.HTMLFiles(card.Manifest.Kind, card.Manifest.ID, len(fronts))
 }
 
 // CompareAndUpdateFile compares the current file content with the new content and updates if necessary
@@ -90,15 +189,10 @@ func CompareAndUpdateFile(filename, newContent string) error {
 	return ioutil.WriteFile(filename, []byte(newContent), 0644)
 }
 
-// SaveToFile saves the LaTeX content to a .tex file, comparing it with the existing content
-func SaveToFile(filename, preamble, content string) error {
-	texContent := preamble + "\\begin{document}\n" + content + "\n\\end{document}"
-	return CompareAndUpdateFile(filename, texContent)
-}
-
 func main() {
 	// Add command-line flag for Zettel name
 	zettelName := flag.String("z", "", "Name of the Zettel to extract flashcards from")
+	assign := flag.Bool("assign-ids", false, "Write generated ids into flashcard environments without one first")
 	flag.Parse()
 
 	// Validate that the Zettel name was provided
@@ -106,19 +200,18 @@ func main() {
 		logging.PanicWithLog("You must provide a Zettel name using the -z option.")
 	}
 
-	// Fetch the Zettel path using the xk API
-	zettelPaths, err := api.Xk("path", map[string]string{"z": *zettelName})
+	k, err := kasten.FromEnv()
 	if err != nil {
-		logging.PanicWithLog("Error fetching Zettel path: %v", err)
+		logging.PanicWithLog("Error opening kasten: %v", err)
 	}
 
-	if len(zettelPaths) == 0 {
-		logging.PanicWithLog("No paths returned for the provided Zettel name.")
+	// Fetch the Zettel path and determine the directory of zettel.tex
+	zettelPath, err := k.Path(*zettelName)
+	if err != nil {
+		logging.PanicWithLog("Error fetching Zettel path: %v", err)
 	}
 
-	// Use the first path and determine the directory of zettel.tex
-	zettelPath := zettelPaths[0]
-	texFilePath := filepath.Join(zettelPath, "zettel.tex")
+	texFilePath := filepath.Join(zettelPath, k.ZettelFilename)
 	logFilePath := filepath.Join(zettelPath, "flashcards.log")
 
 	// Get the directory of zettel.tex
@@ -137,6 +230,46 @@ func main() {
 		logging.PanicWithLog("Error truncating log file: %v", err)
 	}
 
+	lang := sitter.NewLanguage(treesitter.Language())
+
+	// Skip the zettel if the parse cache shows that all card files are current
+	parseCache, err := cache.Open(k)
+	if err != nil {
+		logging.PanicWithLog("Error opening parse cache: %v", err)
+	}
+	cacheParser, err := cache.NewParser(lang)
+	if err != nil {
+		logging.PanicWithLog("Error compiling reference query: %v", err)
+	}
+	defer cacheParser.Close()
+
+	if *assign {
+		if err := assignIDs(k, parseCache, cacheParser, lang, texFilePath); err != nil {
+			logging.PanicWithLog("Error assigning flashcard ids: %v", err)
+		}
+	}
+
+	entry, err := parseCache.Entry(cacheParser, *zettelName)
+	if err != nil {
+		logging.PanicWithLog("Error reading zettel.tex: %v", err)
+	}
+	if err := parseCache.Save(); err != nil {
+		log.Printf("Error saving parse cache: %v", err)
+	}
+
+	// The manifest of the previous run, if there is a usable one
+	var previous *flashcard.Manifest
+	if manifest, err := flashcard.ReadManifest(zettelDir); err == nil {
+		previous = &manifest
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Ignoring manifest: %v", err)
+	}
+
+	if CardFilesCurrent(entry, previous, zettelDir) {
+		log.Println("Flashcards are up to date.")
+		return
+	}
+
 	// Read the content of zettel.tex
 	source, err := ioutil.ReadFile(texFilePath)
 	if err != nil {
@@ -146,7 +279,6 @@ func main() {
 	// Initialize parser for LaTeX
 	parser := sitter.NewParser()
 	defer parser.Close()
-	lang := sitter.NewLanguage(treesitter.Language())
 	parser.SetLanguage(lang)
 
 	// Parse LaTeX content
@@ -155,48 +287,97 @@ func main() {
 
 	// Find document environment
 	rootNode := tree.RootNode()
-	documentEnv := treesitter.FindGenericEnvironment(rootNode, source, "document")
-	if len(documentEnv) == 0 {
+	document := treesitter.FindDocument(rootNode, source)
+	if document == nil {
 		logging.PanicWithLog("No document environment found in zettel.tex")
 	}
 
-	preamble := string(source[:documentEnv[0].EnvironmentNode.StartByte()])
+	preamble := string(source[:document.StartByte()])
 
-	// Find all flashcard environments
-	cardEnvs := treesitter.FindGenericEnvironment(rootNode, source, "flashcard")
-	var flashcards []FlashCard
-	validIDs := make(map[string]bool)
+	// math in HTML cards may use the macros the zettel defines
+	htmlOptions := treesitter.HTMLOptions{Macros: treesitter.Macros(rootNode, source)}
 
-	for _, env := range cardEnvs {
-		card, err := EnvToFlashcard(env, source)
+	// Find all flashcard environments, followed by all cloze card environments
+	var cards []RenderedCard
+	for _, env := range treesitter.FindGenericEnvironment(rootNode, source, "flashcard") {
+		card, err := flashcard.EnvToFlashcard(env, source)
 		if err != nil {
 			log.Printf("Error parsing flashcard: %v", err)
 			continue
 		}
-		flashcards = append(flashcards, card)
-		validIDs[card.id] = true
+		rendered := RenderCard(flashcard.KindBasic, card.ID, env, preamble,
+			[]string{card.Front}, []string{card.Back})
+		rendered.Manifest.Render = flashcard.RenderMode(env, source)
+		TranslateCard(&rendered, parser, htmlOptions, []string{card.Front}, []string{card.Back})
+		cards = append(cards, rendered)
+	}
+
+	for _, env := range treesitter.FindGenericEnvironment(rootNode, source, "clozecard") {
+		card, err := flashcard.EnvToClozeCard(env, source)
+		if err != nil {
+			log.Printf("Error parsing cloze card: %v", err)
+			continue
+		}
+		var fronts, backs []string
+		for _, deletion := range card.Deletions {
+			fronts = append(fronts, deletion.Front)
+			backs = append(backs, deletion.Back)
+		}
+		rendered := RenderCard(flashcard.KindCloze, card.ID, env, preamble, fronts, backs)
+		rendered.Manifest.Render = flashcard.RenderMode(env, source)
+		TranslateCard(&rendered, parser, htmlOptions, fronts, backs)
+		cards = append(cards, rendered)
+	}
+
+	var manifest flashcard.Manifest
+	for _, card := range cards {
+		manifest.Cards = append(manifest.Cards, card.Manifest)
 	}
 
 	// Remove obsolete files in the zettel directory
-	err = CheckAndRemoveObsoleteFiles(validIDs, zettelDir)
+	err = RemoveObsoleteFiles(previous, manifest, zettelDir)
 	if err != nil {
 		logging.PanicWithLog("Error checking obsolete files: %v", err)
 	}
 
-	// Save front and back of flashcards to .tex files in the zettel directory
-	for _, card := range flashcards {
-		frontFile := filepath.Join(zettelDir, fmt.Sprintf("card_%s_front.tex", card.id))
-		backFile := filepath.Join(zettelDir, fmt.Sprintf("card_%s_back.tex", card.id))
+	// Save front and back of every card (every deletion of cloze cards) to .tex files in the zettel directory,
+	// and their HTML translations to .html files
+	for _, card := range cards {
+		for i, files := range card.Manifest.Files {
+			if err := CompareAndUpdateFile(filepath.Join(zettelDir, files.Front), card.Fronts[i]); err != nil {
+				log.Printf("Error saving front of card %s: %v", card.Manifest.ID, err)
+				continue
+			}
 
-		if err := SaveToFile(frontFile, preamble, card.front); err != nil {
-			log.Printf("Error saving front of card %s: %v", card.id, err)
-			continue
+			if err := CompareAndUpdateFile(filepath.Join(zettelDir, files.Back), card.Backs[i]); err != nil {
+				log.Printf("Error saving back of card %s: %v", card.Manifest.ID, err)
+				continue
+			}
 		}
 
-		if err := SaveToFile(backFile, preamble, card.back); err != nil {
-			log.Printf("Error saving back of card %s: %v", card.id, err)
-			continue
+		for i, files := range card.Manifest.HTML {
+			if err := CompareAndUpdateFile(filepath.Join(zettelDir, files.Front), card.HTMLFronts[i]); err != nil {
+				log.Printf("Error saving HTML front of card %s: %v", card.Manifest.ID, err)
+				continue
+			}
+
+			if err := CompareAndUpdateFile(filepath.Join(zettelDir, files.Back), card.HTMLBacks[i]); err != nil {
+				log.Printf("Error saving HTML back of card %s: %v", card.Manifest.ID, err)
+				continue
+			}
+		}
+	}
+
+	// Zettels without cards have no manifest
+	manifestPath := filepath.Join(zettelDir, flashcard.ManifestFilename)
+	if len(manifest.Cards) == 0 {
+		if err := os.Remove(manifestPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logging.PanicWithLog("Error removing manifest: %v", err)
 		}
+	} else if written, err := flashcard.WriteManifest(zettelDir, manifest); err != nil {
+		logging.PanicWithLog("Error writing manifest: %v", err)
+	} else if written {
+		log.Println("Updating file:", manifestPath)
 	}
 
 	log.Println("Flashcards processed successfully.")
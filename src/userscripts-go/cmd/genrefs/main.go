@@ -4,178 +4,160 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"sort"
-	"xk/src/userscripts-go/pkg/api"
+	"runtime"
+	"strings"
+	"sync"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/kasten"
 	"xk/src/userscripts-go/pkg/logging"
 	"xk/src/userscripts-go/pkg/treesitter"
 
 	sitter "github.com/smacker/go-tree-sitter"
 )
 
-// Array to hold the LaTeX commands to extract as references
-var latexCommands = []string{"cite"}
-
 func main() {
 	// Add a command-line flag for the Zettel name
 	zettelName := flag.String("z", "", "Name of the Zettel to extract references from")
-	refQuery, set := os.LookupEnv("TS_QUERY_REF")
-	if !set || refQuery == "" {
-		logging.PanicWithLog("Treesitter query for references not configured.")
-	}
-
+	all := flag.Bool("all", false, "Extract references of every Zettel in the kasten")
+	stdin := flag.Bool("stdin", false, "Read the names of the Zettels to process from stdin, one per line")
+	jobs := flag.Int("j", runtime.NumCPU(), "Number of Zettels to parse concurrently")
+	check := flag.Bool("check", false, "Print a diff and exit non-zero if a references file is stale, without writing")
+	dryRun := flag.Bool("dry-run", false, "Print a diff of the changes without writing anything")
 	flag.Parse()
 
-	// Check if the Zettel name is provided
-	if *zettelName == "" {
-		logging.PanicWithLog("You must provide a Zettel name using the -z option.")
+	mode := ModeWrite
+	if *check {
+		mode = ModeCheck
+	} else if *dryRun {
+		mode = ModeDryRun
 	}
 
-	// Use xk API to get the path to the Zettel
-	zettelPaths, err := api.Xk("path", map[string]string{"z": *zettelName})
-	if err != nil {
-		logging.PanicWithLog("Error fetching Zettel path: %v", err)
+	// Check if exactly one source of Zettel names is provided
+	if (*zettelName != "") == (*all || *stdin) || (*all && *stdin) {
+		logging.PanicWithLog("You must provide a Zettel name using the -z option, or one of -all and -stdin.")
 	}
 
-	// Check if we have any paths; if not, throw an error
-	if len(zettelPaths) == 0 {
-		logging.PanicWithLog("Error: No paths returned for the given Zettel name.")
-	}
-
-	// Use only the first path
-	zettelPath := zettelPaths[0]
-
-	// Define paths for zettel.tex and references.log
-	texFilePath := filepath.Join(zettelPath, "zettel.tex")
-	referencesFilePath := filepath.Join(zettelPath, "references")
-	logFilePath := filepath.Join(zettelPath, "references.log")
-
-	// Open or create the log file and set log output
-	logFile, err := logging.SetLogOutput(logFilePath)
+	k, err := kasten.FromEnv()
 	if err != nil {
-		logging.PanicWithLog("Error setting log output: %v", err)
+		logging.PanicWithLog("Error opening kasten: %v", err)
 	}
-	defer logFile.Close()
 
-	// Truncate the log file to keep only the last N lines
-	err = logging.TruncateLogFile(logFilePath, logging.LogMaxLines)
+	// Validate references against one in-memory set of zettel names
+	zettels, err := k.List()
 	if err != nil {
-		logging.PanicWithLog("Error truncating log file: %v", err)
+		logging.PanicWithLog("Error listing zettels: %v", err)
 	}
-
-	// Read the content of zettel.tex
-	source, err := ioutil.ReadFile(texFilePath)
-	if err != nil {
-		logging.PanicWithLog("Error reading zettel.tex file: %v", err)
+	names := make(map[string]bool, len(zettels))
+	for _, z := range zettels {
+		names[z] = true
 	}
 
-	// Initialize the parser for LaTeX
-	parser := sitter.NewParser()
-	defer parser.Close()
 	lang := sitter.NewLanguage(treesitter.Language())
-	parser.SetLanguage(lang)
-
-	// Parse the source code (LaTeX content)
-	tree := parser.Parse(nil, source)
-	defer tree.Close()
+	backlinks := &sync.Mutex{}
 
-	// Query the tree
-	query, err := sitter.NewQuery([]byte(refQuery), lang)
+	parseCache, err := cache.Open(k)
 	if err != nil {
-		panic(err)
+		logging.PanicWithLog("Error opening parse cache: %v", err)
 	}
-	cursor := sitter.NewQueryCursor()
-	cursor.Exec(query, tree.RootNode())
-
-	refs := map[string]bool{}
-	for {
-		m, ok := cursor.NextMatch()
-		if !ok {
-			break
+	// the cache is internal state, but dry runs still leave it untouched
+	saveCache := func() {
+		if mode != ModeWrite {
+			return
 		}
-		// Apply predicates filtering
-		m = cursor.FilterPredicates(m, source)
-		for _, c := range m.Captures {
-			ref := c.Node.Content(source)
-
-			// strip brackets if necessary
-			sref := ref[1 : len(ref)-1]
-			if ref == fmt.Sprintf("{%s}", sref) || ref == fmt.Sprintf("[%s]", sref) {
-				ref = sref
-			}
-
-			// validate zettels existence
-			_, err := api.Xk("path", map[string]string{"z": ref})
-			if err != nil {
-				// Log the error but continue with the next reference
-				log.Printf("Invalid reference %s: %v", ref, err)
-				continue
-			}
-			refs[ref] = true
+		if err := parseCache.Save(); err != nil {
+			log.Printf("Error saving parse cache: %v", err)
 		}
 	}
 
-	// Create a slice from the map keys and sort them alphabetically
-	var sortedRefs []string
-	for ref := range refs {
-		sortedRefs = append(sortedRefs, ref)
-	}
-	sort.Strings(sortedRefs) // Alphabetically sort the references
-
-	// Create a temporary file to store the references
-	tmpFile, err := ioutil.TempFile("", "references-*.tmp")
-	if err != nil {
-		logging.PanicWithLog("Error creating temporary file: %v", err)
-	}
-	defer os.Remove(tmpFile.Name()) // Ensure the temp file is removed after use
+	// Single Zettel: keep the log in the zettel's references.log
+	if *zettelName != "" {
+		worker, err := NewWorker(k, names, parseCache, lang, backlinks, mode)
+		if err != nil {
+			logging.PanicWithLog("Error compiling reference query: %v", err)
+		}
+		defer worker.Close()
 
-	// Write the sorted references into the temporary file, one per line
-	writer := bufio.NewWriter(tmpFile)
-	for _, ref := range sortedRefs {
-		_, err := writer.WriteString(ref + "\n")
+		changes, err := worker.Update(*zettelName)
+		saveCache()
 		if err != nil {
-			logging.PanicWithLog("Error writing to temporary file: %v", err)
+			logging.PanicWithLog("%v", err)
 		}
-	}
-	writer.Flush()
-	tmpFile.Close()
-
-	// Check if the references file exists
-	if _, err := os.Stat(referencesFilePath); os.IsNotExist(err) {
-		// If it doesn't exist, create it
-		log.Println("References file does not exist, creating it.")
-		if _, err := os.Create(referencesFilePath); err != nil {
-			logging.PanicWithLog("Error creating references file: %v", err)
+		if mode != ModeWrite {
+			fmt.Print(changes)
 		}
+		if mode == ModeCheck && changes != "" {
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Show a diff between the old references file and the temporary file
-	diffCmd := exec.Command("diff", "-u", referencesFilePath, tmpFile.Name())
-	diffOutput, err := diffCmd.CombinedOutput()
-	if err != nil &&
-		err.Error() != "exit status 1" { // exit status 1 means diff found differences, not an actual error
-		logging.PanicWithLog("Error running diff: %v", err)
+	if *stdin {
+		zettels = nil
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if z := strings.TrimSpace(scanner.Text()); z != "" {
+				zettels = append(zettels, kasten.Normalize(z))
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("Error reading Zettel names from stdin: %v", err)
+		}
 	}
-	if len(diffOutput) > 0 {
-		log.Println("Changes in references:")
-		log.Println(string(diffOutput))
-	} else {
-		log.Println("No changes in references.")
+
+	if *jobs < 1 {
+		*jobs = 1
 	}
 
-	// Overwrite the references file with the temporary file contents
-	tempContents, err := ioutil.ReadFile(tmpFile.Name())
-	if err != nil {
-		logging.PanicWithLog("Error reading temporary file: %v", err)
+	// Compile every query up front, so a broken query fails before any work starts
+	var workers []*Worker
+	for i := 0; i < *jobs && i < len(zettels); i++ {
+		worker, err := NewWorker(k, names, parseCache, lang, backlinks, mode)
+		if err != nil {
+			log.Fatalf("Error compiling reference query: %v", err)
+		}
+		workers = append(workers, worker)
+	}
+
+	queue := make(chan string)
+	var failed, stale []string
+	var resultMu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, worker := range workers {
+		wg.Add(1)
+		go func(worker *Worker) {
+			defer wg.Done()
+			defer worker.Close()
+			for z := range queue {
+				changes, err := worker.Update(z)
+
+				resultMu.Lock()
+				if err != nil {
+					log.Printf("%s: %v", z, err)
+					failed = append(failed, z)
+				}
+				if changes != "" {
+					stale = append(stale, z)
+					if mode != ModeWrite {
+						fmt.Print(changes)
+					}
+				}
+				resultMu.Unlock()
+			}
+		}(worker)
 	}
-	err = ioutil.WriteFile(referencesFilePath, tempContents, 0644)
-	if err != nil {
-		logging.PanicWithLog("Error writing to references file: %v", err)
+
+	for _, z := range zettels {
+		queue <- z
 	}
+	close(queue)
+	wg.Wait()
+	saveCache()
 
-	log.Println("References file updated successfully.")
+	log.Printf("Processed %d zettels, %d changed, %d failed", len(zettels), len(stale), len(failed))
+	if len(failed) > 0 || (mode == ModeCheck && len(stale) > 0) {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/diff"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/logging"
+	"xk/src/userscripts-go/pkg/references"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// Mode controls whether a worker writes the references it extracted
+type Mode int
+
+const (
+	ModeWrite  Mode = iota // overwrite the references file
+	ModeCheck              // only compute the diff, the run fails if it is not empty
+	ModeDryRun             // only compute the diff
+)
+
+// Worker extracts references with its own parser and compiled query,
+// so several workers can run concurrently. Unchanged zettels are not
+// reparsed but taken from the shared parse cache.
+type Worker struct {
+	kasten    *kasten.Kasten
+	names     map[string]bool // all zettels of the kasten
+	cache     *cache.Cache
+	parser    *cache.Parser
+	backlinks *sync.Mutex // serializes backlink updates shared between workers
+	mode      Mode
+}
+
+// NewWorker creates a worker with a fresh parser and query for the given language.
+func NewWorker(
+	k *kasten.Kasten,
+	names map[string]bool,
+	c *cache.Cache,
+	lang *sitter.Language,
+	backlinks *sync.Mutex,
+	mode Mode,
+) (*Worker, error) {
+	parser, err := cache.NewParser(lang)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Worker{
+		kasten:    k,
+		names:     names,
+		cache:     c,
+		parser:    parser,
+		backlinks: backlinks,
+		mode:      mode,
+	}, nil
+}
+
+// Close releases the parser and query of the worker.
+func (w *Worker) Close() {
+	w.parser.Close()
+}
+
+// Update regenerates the references file of a zettel and its references.json
+// sidecar, and logs to its references.log.
+// It returns a unified diff between the old and the new references file.
+// In check and dry-run mode nothing is written and the log goes to stderr.
+func (w *Worker) Update(zettel string) (string, error) {
+	// Get the path to the Zettel
+	zettelPath, err := w.kasten.Path(zettel)
+	if err != nil {
+		return "", fmt.Errorf("error fetching Zettel path: %v", err)
+	}
+
+	// Define paths for the references files and references.log
+	referencesFilePath := filepath.Join(zettelPath, w.kasten.ReferenceFilename)
+	sidecarFilePath := referencesFilePath + ".json"
+	logFilePath := filepath.Join(zettelPath, "references.log")
+
+	logger := log.New(os.Stderr, zettel+": ", log.LstdFlags)
+	if w.mode == ModeWrite {
+		// Open or create the (truncated) log file
+		fileLogger, logFile, err := logging.NewFileLogger(logFilePath)
+		if err != nil {
+			return "", fmt.Errorf("error setting log output: %v", err)
+		}
+		defer logFile.Close()
+		logger = fileLogger
+	}
+
+	fail := func(format string, args ...any) (string, error) {
+		logger.Printf(format, args...)
+		return "", fmt.Errorf(format, args...)
+	}
+
+	// Look up the references, the zettel is only parsed if it changed
+	entry, err := w.cache.Entry(w.parser, zettel)
+	if err != nil {
+		return fail("error reading zettel.tex file: %v", err)
+	}
+	occurrences := entry.Occurrences
+	refs := map[string]bool{}
+	for _, ref := range references.Targets(occurrences) {
+		// validate zettels existence
+		if !w.names[ref] {
+			// Log the error but continue with the next reference
+			logger.Printf("Invalid reference %s: zettel does not exist", ref)
+			continue
+		}
+		refs[ref] = true
+	}
+
+	// Create a slice from the map keys and sort them alphabetically
+	var sortedRefs []string
+	for ref := range refs {
+		sortedRefs = append(sortedRefs, ref)
+	}
+	sort.Strings(sortedRefs) // Alphabetically sort the references
+
+	// The new content of the references file, one reference per line
+	newContent := ""
+	for _, ref := range sortedRefs {
+		newContent += ref + "\n"
+	}
+
+	// Read the current references file (a missing file counts as empty)
+	oldContent, err := os.ReadFile(referencesFilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return fail("error reading references file: %v", err)
+	}
+	exists := err == nil
+
+	// Show a diff between the old and the new references
+	name := filepath.Join(zettel, w.kasten.ReferenceFilename)
+	changes := diff.Unified("a/"+name, "b/"+name, diff.Lines(string(oldContent)), diff.Lines(newContent))
+
+	if w.mode != ModeWrite {
+		return changes, nil
+	}
+
+	if changes != "" {
+		logger.Println("Changes in references:")
+		logger.Println(changes)
+	} else {
+		logger.Println("No changes in references.")
+	}
+
+	// Positions change with every edit, so the sidecar is refreshed even if the references are not
+	sidecar := references.NewSidecar(zettel, occurrences, func(ref string) bool { return refs[ref] })
+	if err := writeIfChanged(sidecarFilePath, sidecar); err != nil {
+		return fail("error writing references sidecar: %v", err)
+	}
+
+	if exists && string(oldContent) == newContent {
+		return "", nil
+	}
+
+	// Remember the current references to update backlinks incrementally
+	oldRefs, err := w.kasten.Refs(zettel)
+	if err != nil {
+		return fail("error reading references file: %v", err)
+	}
+
+	// Overwrite the references file with the new contents
+	err = os.WriteFile(referencesFilePath, []byte(newContent), 0644)
+	if err != nil {
+		return fail("error writing to references file: %v", err)
+	}
+
+	logger.Println("References file updated successfully.")
+
+	// Rewrite the backlinks of the zettels that gained or lost this reference
+	w.backlinks.Lock()
+	rewritten, err := w.kasten.UpdateBacklinks(zettel, oldRefs, sortedRefs)
+	w.backlinks.Unlock()
+	for _, z := range rewritten {
+		logger.Printf("Updated backlinks of %s", z)
+	}
+	if err != nil {
+		logger.Printf("Error updating backlinks: %v", err)
+	}
+
+	return changes, nil
+}
+
+// writeIfChanged stores the sidecar unless the file already has the same content
+func writeIfChanged(path string, sidecar references.Sidecar) error {
+	content, err := sidecar.Marshal()
+	if err != nil {
+		return err
+	}
+	if existing, err := os.ReadFile(path); err == nil && string(existing) == string(content) {
+		return nil
+	}
+	return os.WriteFile(path, content, 0644)
+}
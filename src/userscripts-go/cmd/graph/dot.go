@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// dotID quotes a string for use as a Graphviz identifier
+func dotID(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// WriteDOT writes the graph in Graphviz DOT format.
+// With clusters enabled, every zettel is drawn inside the cluster of its first tag.
+func WriteDOT(w io.Writer, g *Graph, clusters bool) error {
+	b := bufio.NewWriter(w)
+
+	fmt.Fprintln(b, "digraph kasten {")
+	fmt.Fprintln(b, "\tnode [shape=box];")
+
+	if clusters {
+		byTag := map[string][]string{}
+		var untagged []string
+		for _, n := range g.Nodes {
+			if len(n.Tags) == 0 {
+				untagged = append(untagged, n.Name)
+				continue
+			}
+			byTag[n.Tags[0]] = append(byTag[n.Tags[0]], n.Name)
+		}
+
+		var tags []string
+		for tag := range byTag {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+
+		for i, tag := range tags {
+			fmt.Fprintf(b, "\tsubgraph cluster_%d {\n", i)
+			fmt.Fprintf(b, "\t\tlabel=%s;\n", dotID(tag))
+			for _, name := range byTag[tag] {
+				fmt.Fprintf(b, "\t\t%s;\n", dotID(name))
+			}
+			fmt.Fprintln(b, "\t}")
+		}
+		for _, name := range untagged {
+			fmt.Fprintf(b, "\t%s;\n", dotID(name))
+		}
+	} else {
+		for _, n := range g.Nodes {
+			fmt.Fprintf(b, "\t%s;\n", dotID(n.Name))
+		}
+	}
+
+	for _, e := range g.Edges {
+		fmt.Fprintf(b, "\t%s -> %s;\n", dotID(e.From), dotID(e.To))
+	}
+
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+// Node is a zettel together with its tags
+type Node struct {
+	Name string
+	Tags []string
+}
+
+// Edge is a reference from one zettel to another
+type Edge struct {
+	From string
+	To   string
+}
+
+// Graph is the citation graph of a kasten
+type Graph struct {
+	Nodes []Node
+	Edges []Edge
+}
+
+// LoadGraph reads the references and tags files of every zettel.
+// References to zettels that do not exist are dropped.
+func LoadGraph(k *kasten.Kasten) (*Graph, error) {
+	zettels, err := k.List()
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(zettels))
+	for _, z := range zettels {
+		exists[z] = true
+	}
+
+	g := &Graph{}
+	for _, z := range zettels {
+		tags, err := k.Tags(z)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tags of %s: %v", z, err)
+		}
+		sort.Strings(tags)
+		g.Nodes = append(g.Nodes, Node{Name: z, Tags: tags})
+
+		refs, err := k.Refs(z)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read references of %s: %v", z, err)
+		}
+		seen := map[string]bool{}
+		for _, ref := range refs {
+			if !exists[ref] || seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			g.Edges = append(g.Edges, Edge{From: z, To: ref})
+		}
+	}
+
+	return g, nil
+}
+
+// FilterTags keeps only the zettels carrying at least one of the given tags.
+func (g *Graph) FilterTags(tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	wanted := make(map[string]bool, len(tags))
+	for _, t := range tags {
+		wanted[t] = true
+	}
+
+	g.keep(func(n Node) bool {
+		for _, t := range n.Tags {
+			if wanted[t] {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Neighbourhood keeps only the zettels within depth hops of root,
+// following references in both directions. A negative depth means no limit.
+func (g *Graph) Neighbourhood(root string, depth int) error {
+	adjacent := map[string][]string{}
+	found := false
+	for _, n := range g.Nodes {
+		if n.Name == root {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("zettel %s is not part of the graph", root)
+	}
+
+	for _, e := range g.Edges {
+		adjacent[e.From] = append(adjacent[e.From], e.To)
+		adjacent[e.To] = append(adjacent[e.To], e.From)
+	}
+
+	distance := map[string]int{root: 0}
+	queue := []string{root}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if depth >= 0 && distance[current] >= depth {
+			continue
+		}
+		for _, next := range adjacent[current] {
+			if _, visited := distance[next]; !visited {
+				distance[next] = distance[current] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	g.keep(func(n Node) bool {
+		_, ok := distance[n.Name]
+		return ok
+	})
+	return nil
+}
+
+// keep removes every node rejected by the predicate and all edges touching it.
+func (g *Graph) keep(predicate func(Node) bool) {
+	kept := map[string]bool{}
+	var nodes []Node
+	for _, n := range g.Nodes {
+		if predicate(n) {
+			kept[n.Name] = true
+			nodes = append(nodes, n)
+		}
+	}
+
+	var edges []Edge
+	for _, e := range g.Edges {
+		if kept[e.From] && kept[e.To] {
+			edges = append(edges, e)
+		}
+	}
+
+	g.Nodes, g.Edges = nodes, edges
+}
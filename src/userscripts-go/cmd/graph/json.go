@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+type jsonNode struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+type jsonEdge struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type jsonGraph struct {
+	Nodes []jsonNode `json:"nodes"`
+	Edges []jsonEdge `json:"edges"`
+}
+
+// WriteJSON writes the graph as a JSON node/edge list.
+func WriteJSON(w io.Writer, g *Graph) error {
+	out := jsonGraph{Nodes: []jsonNode{}, Edges: []jsonEdge{}}
+
+	for _, n := range g.Nodes {
+		tags := n.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		out.Nodes = append(out.Nodes, jsonNode{ID: n.Name, Tags: tags})
+	}
+	for _, e := range g.Edges {
+		out.Edges = append(out.Edges, jsonEdge{Source: e.From, Target: e.To})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
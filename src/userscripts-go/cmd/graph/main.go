@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+func main() {
+	format := flag.String("format", "dot", "Output format: dot, graphml, json or ttl")
+	output := flag.String("o", "", "Write the graph to this file instead of stdout")
+	tags := flag.String("tag", "", "Comma separated list of tags; only zettels with one of them are exported")
+	root := flag.String("root", "", "Only export the neighbourhood of this zettel")
+	depth := flag.Int("depth", -1, "Maximum distance from -root (negative means unlimited)")
+	clusters := flag.Bool("clusters", false, "Group zettels into clusters by tag (dot only)")
+	base := flag.String("base", "", "Base IRI for zettel resources (ttl only, defaults to the kasten path)")
+	flag.Parse()
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	g, err := LoadGraph(k)
+	if err != nil {
+		log.Fatalf("Error loading graph: %v", err)
+	}
+
+	if *tags != "" {
+		g.FilterTags(strings.Split(*tags, ","))
+	}
+
+	if *root != "" {
+		if err := g.Neighbourhood(kasten.Normalize(*root), *depth); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating output file: %v", err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch *format {
+	case "dot":
+		err = WriteDOT(w, g, *clusters)
+	case "graphml":
+		err = WriteGraphML(w, g)
+	case "json":
+		err = WriteJSON(w, g)
+	case "ttl", "turtle", "rdf":
+		if *base == "" {
+			*base = (&url.URL{Scheme: "file", Path: k.Root + "/"}).String()
+		}
+		err = WriteTurtle(w, g, *base)
+	default:
+		err = fmt.Errorf("unknown format %s", *format)
+	}
+
+	if err != nil {
+		log.Fatalf("Error exporting graph: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// turtleString escapes a string literal for Turtle
+func turtleString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// WriteTurtle writes the graph as RDF in Turtle syntax.
+// Zettels become resources below base, references become xk:references triples.
+func WriteTurtle(w io.Writer, g *Graph, base string) error {
+	b := bufio.NewWriter(w)
+
+	iri := func(name string) string {
+		return "<" + base + url.PathEscape(name) + ">"
+	}
+
+	fmt.Fprintln(b, "@prefix xk: <https://github.com/lentilus/xk/ns#> .")
+	fmt.Fprintln(b, "@prefix rdfs: <http://www.w3.org/2000/01/rdf-schema#> .")
+
+	outgoing := map[string][]string{}
+	for _, e := range g.Edges {
+		outgoing[e.From] = append(outgoing[e.From], e.To)
+	}
+
+	for _, n := range g.Nodes {
+		fmt.Fprintln(b)
+		fmt.Fprintf(b, "%s a xk:Zettel ;\n", iri(n.Name))
+		fmt.Fprintf(b, "    rdfs:label %s", turtleString(strings.ReplaceAll(n.Name, "_", " ")))
+		for _, tag := range n.Tags {
+			fmt.Fprintf(b, " ;\n    xk:tag %s", turtleString(tag))
+		}
+		for _, ref := range outgoing[n.Name] {
+			fmt.Fprintf(b, " ;\n    xk:references %s", iri(ref))
+		}
+		fmt.Fprintln(b, " .")
+	}
+
+	return b.Flush()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+	"unicode/utf8"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// document is an open zettel.tex together with its syntax tree.
+// Positions are always derived from byte offsets and the line index,
+// never from node points, as the vendored bindings pass the old end point
+// as the new one to ts_tree_edit and points after an edit may be off.
+type document struct {
+	uri     string
+	zettel  string // empty if the file is not a zettel of the kasten
+	version int
+	text    []byte
+	lines   []uint32 // byte offsets of the line starts
+	tree    *sitter.Tree
+}
+
+func newDocument(parser *sitter.Parser, uri, zettel string, version int, text []byte) *document {
+	d := &document{uri: uri, zettel: zettel, version: version, text: text}
+	d.index()
+	d.tree = parser.Parse(nil, d.text)
+	return d
+}
+
+// close releases the syntax tree
+func (d *document) close() {
+	d.tree.Close()
+}
+
+// index recomputes the line starts
+func (d *document) index() {
+	d.lines = []uint32{0}
+	for i, c := range d.text {
+		if c == '\n' {
+			d.lines = append(d.lines, uint32(i+1))
+		}
+	}
+}
+
+// line returns the zero based line containing the byte offset
+func (d *document) line(offset uint32) int {
+	return sort.Search(len(d.lines), func(i int) bool { return d.lines[i] > offset }) - 1
+}
+
+// lineEnd returns the byte offset of the newline ending the line (or the end of the text)
+func (d *document) lineEnd(line int) uint32 {
+	if line+1 < len(d.lines) {
+		return d.lines[line+1] - 1
+	}
+	return uint32(len(d.text))
+}
+
+// offset converts an LSP position to a byte offset, clamping it to the text
+func (d *document) offset(pos Position) uint32 {
+	if pos.Line < 0 {
+		return 0
+	}
+	if pos.Line >= len(d.lines) {
+		return uint32(len(d.text))
+	}
+
+	offset, end := d.lines[pos.Line], d.lineEnd(pos.Line)
+	for units := 0; units < pos.Character && offset < end; {
+		r, size := utf8.DecodeRune(d.text[offset:end])
+		units += utf16Len(r)
+		offset += uint32(size)
+	}
+	return offset
+}
+
+// position converts a byte offset to an LSP position
+func (d *document) position(offset uint32) Position {
+	offset = min(offset, uint32(len(d.text)))
+	line := d.line(offset)
+
+	units := 0
+	for i := d.lines[line]; i < offset; {
+		r, size := utf8.DecodeRune(d.text[i:offset])
+		units += utf16Len(r)
+		i += uint32(size)
+	}
+	return Position{Line: line, Character: units}
+}
+
+// span converts a byte range to an LSP range
+func (d *document) span(start, end uint32) Range {
+	return Range{Start: d.position(start), End: d.position(end)}
+}
+
+// point converts a byte offset to a tree-sitter point (zero based row and byte column)
+func (d *document) point(offset uint32) sitter.Point {
+	line := d.line(offset)
+	return sitter.Point{Row: uint32(line), Column: offset - d.lines[line]}
+}
+
+// apply performs the changes of a didChange notification. Every ranged change
+// is reported to the old tree with Tree.Edit so that the following parse only
+// re-parses the edited regions.
+func (d *document) apply(parser *sitter.Parser, version int, changes []TextDocumentContentChangeEvent) {
+	old := d.tree
+	for _, c := range changes {
+		if c.Range == nil {
+			// the whole document was replaced, nothing can be reused
+			d.text = []byte(c.Text)
+			d.index()
+			if old != nil {
+				old.Close()
+				old = nil
+			}
+			continue
+		}
+
+		start, oldEnd := d.offset(c.Range.Start), d.offset(c.Range.End)
+		if oldEnd < start {
+			start, oldEnd = oldEnd, start
+		}
+		startPoint, oldEndPoint := d.point(start), d.point(oldEnd)
+
+		text := make([]byte, 0, len(d.text)-int(oldEnd-start)+len(c.Text))
+		text = append(text, d.text[:start]...)
+		text = append(text, c.Text...)
+		text = append(text, d.text[oldEnd:]...)
+		d.text = text
+		d.index()
+
+		newEnd := start + uint32(len(c.Text))
+		if old != nil {
+			old.Edit(sitter.EditInput{
+				StartIndex:  start,
+				OldEndIndex: oldEnd,
+				NewEndIndex: newEnd,
+				StartPoint:  startPoint,
+				OldEndPoint: oldEndPoint,
+				NewEndPoint: d.point(newEnd),
+			})
+		}
+	}
+
+	d.version = version
+	d.tree = parser.Parse(old, d.text)
+	if old != nil {
+		old.Close()
+	}
+}
+
+// nodeAt returns the smallest node spanning the byte offset.
+// A node ending at the offset counts, so that the cursor right behind a word finds it.
+func (d *document) nodeAt(offset uint32) *sitter.Node {
+	node := d.tree.RootNode()
+	for {
+		var next *sitter.Node
+		for i := 0; i < int(node.ChildCount()); i++ {
+			child := node.Child(i)
+			if child.StartByte() <= offset && offset <= child.EndByte() {
+				next = child
+				if offset < child.EndByte() {
+					break
+				}
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+}
+
+// utf16Len returns the number of UTF-16 code units of a rune
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"os"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/references"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// lsp is a language server for zettel files speaking LSP over stdin and stdout.
+// Editors start it through xk so that the kasten configuration is exported:
+//
+//	xk script lsp
+func main() {
+	// stdout carries the protocol, diagnostics of the server itself go to stderr
+	log.SetOutput(os.Stderr)
+	log.SetPrefix("xk-lsp: ")
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	// Initialize the parser for LaTeX
+	parser := sitter.NewParser()
+	defer parser.Close()
+	lang := sitter.NewLanguage(treesitter.Language())
+	parser.SetLanguage(lang)
+
+	extractor, err := references.NewExtractor(lang)
+	if err != nil {
+		log.Fatalf("Error compiling reference query: %v", err)
+	}
+	defer extractor.Close()
+
+	server := NewServer(newConn(os.Stdin, os.Stdout), k, parser, extractor)
+	if err := server.Run(); err != nil {
+		log.Fatalf("Error serving: %v", err)
+	}
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/references"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// rpcError is returned by handlers to answer a request with a JSON-RPC error
+type rpcError struct {
+	code    int
+	message string
+}
+
+func (e *rpcError) Error() string {
+	return e.message
+}
+
+// Server answers the requests of one editor session. Messages are handled
+// one after another, so no locking is needed.
+type Server struct {
+	conn      *conn
+	kasten    *kasten.Kasten
+	parser    *sitter.Parser
+	refs      *references.Extractor
+	documents map[string]*document // open documents by uri
+	shutdown  bool
+}
+
+func NewServer(c *conn, k *kasten.Kasten, parser *sitter.Parser, refs *references.Extractor) *Server {
+	return &Server{
+		conn:      c,
+		kasten:    k,
+		parser:    parser,
+		refs:      refs,
+		documents: map[string]*document{},
+	}
+}
+
+// Run serves messages until the client sends exit or closes the connection.
+func (s *Server) Run() error {
+	defer func() {
+		for _, d := range s.documents {
+			d.close()
+		}
+	}()
+
+	for {
+		body, err := s.conn.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.conn.write(errorResponse{"2.0", nil, responseError{codeParseError, err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return errors.New("exit before shutdown")
+			}
+			return nil
+		}
+
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			// notifications are never answered
+			if err != nil {
+				log.Printf("Error handling %s: %v", msg.Method, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			var rerr *rpcError
+			if !errors.As(err, &rerr) {
+				rerr = &rpcError{codeInternalError, err.Error()}
+			}
+			err = s.conn.write(errorResponse{"2.0", msg.ID, responseError{rerr.code, rerr.message}})
+		} else {
+			err = s.conn.write(response{"2.0", msg.ID, result})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches a message to its handler
+func (s *Server) handle(msg message) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		return s.initialize()
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.didOpen(params)
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.didChange(params)
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.didClose(params)
+
+	case "textDocument/completion":
+		var params TextDocumentPositionParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.completion(params)
+	case "textDocument/definition":
+		var params TextDocumentPositionParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.definition(params)
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.hover(params)
+	case "textDocument/references":
+		var params ReferenceParams
+		if err := decode(msg.Params, &params); err != nil {
+			return nil, err
+		}
+		return s.references(params)
+	}
+
+	if msg.ID == nil {
+		// unknown notifications like $/cancelRequest or didSave are ignored
+		return nil, nil
+	}
+	return nil, &rpcError{codeMethodNotFound, fmt.Sprintf("method not supported: %s", msg.Method)}
+}
+
+func decode(params json.RawMessage, v any) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return &rpcError{codeInvalidParams, err.Error()}
+	}
+	return nil
+}
+
+func (s *Server) initialize() (InitializeResult, error) {
+	var result InitializeResult
+	result.ServerInfo.Name = "xk-lsp"
+
+	capabilities := &result.Capabilities
+	capabilities.TextDocumentSync.OpenClose = true
+	capabilities.TextDocumentSync.Change = syncIncremental
+	capabilities.CompletionProvider.TriggerCharacters = []string{"{", ","}
+	capabilities.DefinitionProvider = true
+	capabilities.HoverProvider = true
+	capabilities.ReferencesProvider = true
+
+	return result, nil
+}
+
+func (s *Server) didOpen(params DidOpenTextDocumentParams) error {
+	item := params.TextDocument
+	if old, ok := s.documents[item.URI]; ok {
+		old.close()
+	}
+
+	d := newDocument(s.parser, item.URI, s.zettelOf(item.URI), item.Version, []byte(item.Text))
+	s.documents[item.URI] = d
+	return s.publishDiagnostics(d)
+}
+
+func (s *Server) didChange(params DidChangeTextDocumentParams) error {
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return fmt.Errorf("document not open: %s", params.TextDocument.URI)
+	}
+
+	d.apply(s.parser, params.TextDocument.Version, params.ContentChanges)
+	return s.publishDiagnostics(d)
+}
+
+func (s *Server) didClose(params DidCloseTextDocumentParams) error {
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return nil
+	}
+	d.close()
+	delete(s.documents, params.TextDocument.URI)
+
+	// clear the diagnostics of the closed document
+	return s.conn.write(notification{"2.0", "textDocument/publishDiagnostics",
+		PublishDiagnosticsParams{URI: d.uri, Diagnostics: []Diagnostic{}}})
+}
+
+// document returns an open document or an error for unknown uris
+func (s *Server) document(uri string) (*document, error) {
+	d, ok := s.documents[uri]
+	if !ok {
+		return nil, &rpcError{codeInvalidParams, fmt.Sprintf("document not open: %s", uri)}
+	}
+	return d, nil
+}
+
+// zettelOf returns the name of the zettel a uri points to, or "" if it is not a zettel file
+func (s *Server) zettelOf(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return ""
+	}
+
+	path := filepath.Clean(filepath.FromSlash(u.Path))
+	root, err := filepath.Abs(s.kasten.Root)
+	if err != nil {
+		return ""
+	}
+
+	dir := filepath.Dir(path)
+	if filepath.Base(path) != s.kasten.ZettelFilename || filepath.Dir(dir) != root {
+		return ""
+	}
+	return filepath.Base(dir)
+}
+
+// uriOf returns the uri of a zettel file
+func (s *Server) uriOf(zettel string) string {
+	path, err := filepath.Abs(s.kasten.File(zettel, s.kasten.ZettelFilename))
+	if err != nil {
+		path = s.kasten.File(zettel, s.kasten.ZettelFilename)
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
+
+// source returns the content of a zettel, preferring the unsaved state of an open document
+func (s *Server) source(zettel string) ([]byte, error) {
+	if d, ok := s.documents[s.uriOf(zettel)]; ok {
+		return d.text, nil
+	}
+	return os.ReadFile(s.kasten.File(zettel, s.kasten.ZettelFilename))
+}
+
+// citationAt returns the reference under the cursor
+func (s *Server) citationAt(d *document, pos Position) (references.Occurrence, bool) {
+	offset := d.offset(pos)
+	for _, o := range s.refs.Occurrences(d.tree.RootNode(), d.text) {
+		if o.StartByte <= offset && offset <= o.EndByte {
+			return o, true
+		}
+	}
+	return references.Occurrence{}, false
+}
+
+// keyGroup returns the braces holding the keys of the citation or link macro
+// the offset lies in, or nil if the cursor is not inside one.
+func (s *Server) keyGroup(d *document, offset uint32) *sitter.Node {
+	for n := d.nodeAt(offset); n != nil; n = n.Parent() {
+		var group *sitter.Node
+		switch n.Type() {
+		case "citation":
+			group = n.ChildByFieldName("keys")
+		case "generic_command":
+			name := strings.TrimSuffix(strings.TrimPrefix(n.Child(0).Content(d.text), "\\"), "*")
+			for _, command := range s.refs.Commands {
+				if command == name {
+					group = n.ChildByFieldName("arg")
+				}
+			}
+		default:
+			continue
+		}
+
+		if group == nil || offset <= group.StartByte() {
+			return nil
+		}
+		// a citation that is still being typed lacks its closing brace
+		last := group.Child(int(group.ChildCount()) - 1)
+		if offset < group.EndByte() || (last != nil && last.IsMissing()) {
+			return group
+		}
+		return nil
+	}
+	return nil
+}
+
+func (s *Server) completion(params TextDocumentPositionParams) ([]CompletionItem, error) {
+	d, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := d.offset(params.Position)
+	group := s.keyGroup(d, offset)
+	if group == nil {
+		return []CompletionItem{}, nil
+	}
+
+	// the key typed so far starts after the opening brace or the last comma
+	start := offset
+	for start > group.StartByte()+1 && d.text[start-1] != ',' && d.text[start-1] != '{' {
+		start--
+	}
+	prefix := strings.TrimSpace(string(d.text[start:offset]))
+
+	zettels, err := s.kasten.List()
+	if err != nil {
+		return nil, err
+	}
+
+	items := []CompletionItem{}
+	for _, z := range zettels {
+		if strings.HasPrefix(z, prefix) {
+			items = append(items, CompletionItem{Label: z, Kind: completionKindFile})
+		}
+	}
+	return items, nil
+}
+
+func (s *Server) definition(params TextDocumentPositionParams) ([]Location, error) {
+	d, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	o, ok := s.citationAt(d, params.Position)
+	if !ok || !s.kasten.Exists(o.Target) {
+		return []Location{}, nil
+	}
+	return []Location{{URI: s.uriOf(o.Target)}}, nil
+}
+
+func (s *Server) hover(params TextDocumentPositionParams) (*Hover, error) {
+	d, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	o, ok := s.citationAt(d, params.Position)
+	if !ok || !s.kasten.Exists(o.Target) {
+		return nil, nil
+	}
+
+	title, paragraph, err := s.summary(o.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	value := "**" + title + "**"
+	if paragraph != "" {
+		value += "\n\n" + paragraph
+	}
+	span := d.span(o.StartByte, o.EndByte)
+	return &Hover{Contents: MarkupContent{Kind: "markdown", Value: value}, Range: &span}, nil
+}
+
+// references lists the citations of the zettel under the cursor, or of the
+// current zettel if the cursor is not on a citation. The citing zettels are
+// taken from the backlinks file and then searched for the exact positions.
+func (s *Server) references(params ReferenceParams) ([]Location, error) {
+	d, err := s.document(params.TextDocument.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	target := d.zettel
+	if o, ok := s.citationAt(d, params.Position); ok {
+		target = o.Target
+	}
+	if target == "" || !s.kasten.Exists(target) {
+		return []Location{}, nil
+	}
+
+	locations := []Location{}
+	if params.Context.IncludeDeclaration {
+		locations = append(locations, Location{URI: s.uriOf(target)})
+	}
+
+	citing, err := s.kasten.Backlinks(target)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, z := range citing {
+		uri := s.uriOf(z)
+		other, ok := s.documents[uri]
+		if !ok {
+			source, err := os.ReadFile(s.kasten.File(z, s.kasten.ZettelFilename))
+			if err != nil {
+				log.Printf("Error reading %s: %v", z, err)
+				continue
+			}
+			other = newDocument(s.parser, uri, z, 0, source)
+		}
+
+		for _, o := range s.refs.Occurrences(other.tree.RootNode(), other.text) {
+			if o.Target == target {
+				locations = append(locations, Location{URI: uri, Range: other.span(o.StartByte, o.EndByte)})
+			}
+		}
+		if !ok {
+			other.close()
+		}
+	}
+
+	return locations, nil
+}
+
+// summary returns the title and the first paragraph of a zettel. The title is
+// taken from \title or the first heading and defaults to the zettel name.
+func (s *Server) summary(zettel string) (string, string, error) {
+	source, err := s.source(zettel)
+	if err != nil {
+		return "", "", err
+	}
+
+	tree := s.parser.Parse(nil, source)
+	defer tree.Close()
+	root := tree.RootNode()
+
+	title := treesitter.Title(root, source)
+	if title == "" {
+		title = strings.ReplaceAll(zettel, "_", " ")
+	}
+
+	body := treesitter.PlainText(root, source, treesitter.PlainTextOptions{KeepMath: true})
+	for _, paragraph := range strings.Split(body, "\n\n") {
+		if paragraph != "" && paragraph != title {
+			return title, paragraph, nil
+		}
+	}
+	return title, "", nil
+}
+
+// publishDiagnostics reports citations of missing zettels and malformed flashcards
+func (s *Server) publishDiagnostics(d *document) error {
+	diagnostics := []Diagnostic{}
+	report := func(start, end uint32, code, format string, args ...any) {
+		diagnostics = append(diagnostics, Diagnostic{
+			Range:    d.span(start, end),
+			Severity: severityError,
+			Code:     code,
+			Source:   "xk",
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	root := d.tree.RootNode()
+
+	for _, o := range s.refs.Occurrences(root, d.text) {
+		if !s.kasten.Exists(o.Target) {
+			report(o.StartByte, o.EndByte, "broken-citation", "citation of missing zettel %s", o.Target)
+		}
+	}
+
+	ids := map[string]bool{}
+	for _, env := range treesitter.FindGenericEnvironment(root, d.text, "flashcard") {
+		// underline the \begin{flashcard}[...] line only
+		begin := env.EnvironmentNode.ChildByFieldName("begin")
+		start, end := begin.StartByte(), begin.EndByte()
+
+		card, err := flashcard.EnvToFlashcard(env, d.text)
+		switch {
+		case err != nil:
+			report(start, end, "malformed-flashcard", "%v", err)
+		case !flashcard.IDPattern.MatchString(card.ID):
+			report(start, end, "malformed-flashcard", "flashcard id %q must match %s", card.ID, flashcard.IDPattern)
+		case ids[card.ID]:
+			report(start, end, "duplicate-flashcard-id", "flashcard id %s is used twice in this zettel", card.ID)
+		default:
+			ids[card.ID] = true
+		}
+	}
+	for _, env := range treesitter.FindGenericEnvironment(root, d.text, "clozecard") {
+		begin := env.EnvironmentNode.ChildByFieldName("begin")
+		start, end := begin.StartByte(), begin.EndByte()
+
+		card, err := flashcard.EnvToClozeCard(env, d.text)
+		switch {
+		case err != nil:
+			report(start, end, "malformed-flashcard", "%v", err)
+		case !flashcard.IDPattern.MatchString(card.ID):
+			report(start, end, "malformed-flashcard", "cloze card id %q must match %s", card.ID, flashcard.IDPattern)
+		case ids[card.ID]:
+			report(start, end, "duplicate-flashcard-id", "flashcard id %s is used twice in this zettel", card.ID)
+		default:
+			ids[card.ID] = true
+		}
+	}
+
+	return s.conn.write(notification{"2.0", "textDocument/publishDiagnostics",
+		PublishDiagnosticsParams{URI: d.uri, Version: d.version, Diagnostics: diagnostics}})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/search"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+func main() {
+	limit := flag.Int("n", 10, "Maximum number of results")
+	rebuild := flag.Bool("rebuild", false, "Discard the index and rebuild it from scratch")
+	flag.Parse()
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	stateDir, err := k.StateDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	indexPath := filepath.Join(stateDir, "search.gob")
+
+	index := search.NewIndex()
+	if !*rebuild {
+		index, err = search.Load(indexPath)
+		if err != nil {
+			log.Fatalf("Error loading search index: %v", err)
+		}
+	}
+
+	// Initialize the parser for LaTeX
+	parser := sitter.NewParser()
+	defer parser.Close()
+	parser.SetLanguage(sitter.NewLanguage(treesitter.Language()))
+
+	updated, err := index.Update(k, parser)
+	if err != nil {
+		log.Fatalf("Error updating search index: %v", err)
+	}
+	if updated > 0 {
+		if err := index.Save(indexPath); err != nil {
+			log.Fatalf("Error saving search index: %v", err)
+		}
+	}
+
+	terms := search.Terms(strings.Join(flag.Args(), " "))
+	if len(terms) == 0 {
+		return
+	}
+
+	// highlight matches in bold when writing to a terminal
+	pre, post := "*", "*"
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		pre, post = "\x1b[1m", "\x1b[0m"
+	}
+
+	results := index.Search(terms)
+	if len(results) > *limit {
+		results = results[:*limit]
+	}
+
+	for _, r := range results {
+		// only the shown hits are reparsed to build their snippets
+		source, err := os.ReadFile(k.File(r.Zettel, k.ZettelFilename))
+		if err != nil {
+			log.Printf("Error reading %s: %v", r.Zettel, err)
+			continue
+		}
+		tree := parser.Parse(nil, source)
+		tokens := search.Tokenize(tree.RootNode(), source)
+		tree.Close()
+
+		fmt.Printf("%s (%.2f)\n", r.Zettel, r.Score)
+		fmt.Printf("    %s\n", search.Snippet(tokens, source, terms, pre, post))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// batchSize limits the number of actions sent in one multi request
+const batchSize = 50
+
+// Batch queues AnkiConnect actions and sends them with the multi action.
+// Failing actions do not stop the others, their errors are collected.
+type Batch struct {
+	api     API
+	actions []Body
+	labels  []string // what each queued action is for, used in errors
+	errors  []error
+}
+
+// NewBatch creates an empty batch sending its actions to api
+func NewBatch(api API) *Batch {
+	return &Batch{api: api}
+}
+
+// Add queues an action and sends the batch once it is full
+func (b *Batch) Add(label, action string, params P) {
+	b.actions = append(b.actions, Body{action, 6, params})
+	b.labels = append(b.labels, label)
+	if len(b.actions) >= batchSize {
+		b.Flush()
+	}
+}
+
+// Flush sends all queued actions
+func (b *Batch) Flush() {
+	if len(b.actions) == 0 {
+		return
+	}
+	actions, labels := b.actions, b.labels
+	b.actions, b.labels = nil, nil
+
+	log.Printf("Sending %d actions", len(actions))
+	results, err := Multi(b.api, actions)
+	if err != nil {
+		for _, label := range labels {
+			b.errors = append(b.errors, fmt.Errorf("%s: %v", label, err))
+		}
+		return
+	}
+	for i, res := range results {
+		if err := checkAPIError(res.Error); err != nil {
+			b.errors = append(b.errors, fmt.Errorf("%s: %v", labels[i], err))
+		}
+	}
+}
+
+// Errors returns the errors of all actions sent so far
+func (b *Batch) Errors() []error {
+	return b.errors
+}
+
+// QueueMedia queues storing a base64 encoded file in Anki's media folder
+func QueueMedia(batch *Batch, data, filename string) {
+	batch.Add("store "+filename, "storeMediaFile", map[string]any{
+		"filename": filename,
+		"data":     data,
+	})
+}
+
+// Index holds the notes of the xk note types in the deck by card id
+type Index map[string]NoteInfo
+
+// LoadIndex fetches the ids, hashes and fixmes of all notes in the deck with two requests
+func LoadIndex(api API) (Index, error) {
+	noteIDs, err := FindNotes(api, notesQuery())
+	if err != nil {
+		return nil, err
+	}
+
+	index := Index{}
+	if len(noteIDs) == 0 {
+		return index, nil
+	}
+
+	notes, err := NotesInfo(api, noteIDs)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range notes {
+		id := note.Field("id")
+		if other, ok := index[id]; ok {
+			log.Printf("Notes %d and %d share the card ID %q, ignoring the latter", other.NoteID, note.NoteID, id)
+			continue
+		}
+		index[id] = note
+	}
+	return index, nil
+}
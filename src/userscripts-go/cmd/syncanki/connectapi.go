@@ -6,10 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 // generic type for request body parameters
-type P any
+type P = any
 
 // GenericResponse encapsulates a standard API response structure with a result and error
 type GenericResponse[T any] struct {
@@ -104,51 +106,26 @@ func CreateDeck(api API, name string) (int, error) {
 	return res.Result, nil
 }
 
-// stores file with base64 encoded content
-func StoreMediaFile(api API, name string, data string) (string, error) {
-	var res GenericResponse[string]
-	params := map[string]any{"filename": name, "data": data}
-	err := api.Request("storeMediaFile", params, &res)
-	if err != nil {
-		return "", err
-	}
-
-	if err := checkAPIError(res.Error); err != nil {
-		return "", err
-	}
-
-	return res.Result, nil
-}
-
-// retrieves available models
-func GetModels(api API) ([]string, error) {
-	var res GenericResponse[[]string]
-	err := api.Request("modelNames", nil, &res)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := checkAPIError(res.Error); err != nil {
-		return nil, err
-	}
-
-	return res.Result, nil
-}
-
 // creates a new model with specified fields and templates
 func CreateModel(
 	api API,
 	name string,
 	fields []string,
 	templates []map[string]string,
+	isCloze bool,
+	css string,
 ) (any, error) {
 	var res GenericResponse[any]
 	params := map[string]any{
 		"modelName":     name,
 		"inOrderFields": fields,
-		"isCloze":       false,
+		"isCloze":       isCloze,
 		"cardTemplates": templates,
 	}
+	// an empty css would replace Anki's default styling
+	if css != "" {
+		params["css"] = css
+	}
 
 	err := api.Request("createModel", params, &res)
 	if err != nil {
@@ -162,208 +139,220 @@ func CreateModel(
 	return res.Result, nil
 }
 
-// finds a card based on deck name and card id
-func FindCard(api API, deck string, id string) (int, error) {
+// NoteInfo is the part of a notesInfo result syncanki uses
+type NoteInfo struct {
+	NoteID    int                  `json:"noteId"`
+	ModelName string               `json:"modelName"`
+	Fields    map[string]NoteField `json:"fields"`
+	Tags      []string             `json:"tags"`
+	Cards     []int                `json:"cards"`
+}
+
+// NoteField is the value of a note field
+type NoteField struct {
+	Value string `json:"value"`
+	Order int    `json:"order"`
+}
+
+// Field returns the value of a field, or "" if the note has no such field
+func (n NoteInfo) Field(name string) string {
+	return n.Fields[name].Value
+}
+
+// finds the notes matching an Anki search query
+func FindNotes(api API, query string) ([]int, error) {
 	var res GenericResponse[[]int]
 
 	params := map[string]any{
-		"query": fmt.Sprintf("deck:%s id:%s", deck, id),
+		"query": query,
 	}
 
-	err := api.Request("findCards", params, &res)
-	if err != nil {
-		return -1, err
+	if err := api.Request("findNotes", params, &res); err != nil {
+		return nil, err
 	}
 
 	if err := checkAPIError(res.Error); err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	// We expect exactly one result
-	if len(res.Result) == 0 {
-		return -1, nil
-	}
+	return res.Result, nil
+}
 
-	if len(res.Result) != 1 {
-		return -1, errors.New("We expected 0 or 1 matches.")
-	}
+// searchTerm quotes a term of an Anki search, e.g. "deck:Math Notes", so that
+// spaces and parentheses in names are matched literally. The _ and * wildcards
+// are escaped as well.
+func searchTerm(name, value string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `*`, `\*`, `_`, `\_`).Replace(value)
+	return `"` + name + ":" + escaped + `"`
+}
 
-	// return Card2Note(api, res.Result[0])
-	return res.Result[0], nil
+// notesQuery searches the notes of the xk note types in the deck
+func notesQuery() string {
+	return fmt.Sprintf("%s (%s OR %s)",
+		searchTerm("deck", deck), searchTerm("note", modelName), searchTerm("note", clozeModelName))
 }
 
-// converts a card to its corresponding note
-func Card2Note(api API, id int) (int, error) {
-	var res GenericResponse[[]int]
+// retrieves fields and cards of notes
+func NotesInfo(api API, notes []int) ([]NoteInfo, error) {
+	var res GenericResponse[[]NoteInfo]
 
 	params := map[string]any{
-		"cards": []int{id},
+		"notes": notes,
 	}
 
-	err := api.Request("cardsToNotes", params, &res)
-	if err != nil {
-		return -1, err
+	if err := api.Request("notesInfo", params, &res); err != nil {
+		return nil, err
 	}
 
 	if err := checkAPIError(res.Error); err != nil {
-		return -1, err
+		return nil, err
 	}
 
-	if len(res.Result) != 1 {
-		return -1, errors.New("expected exactly one match")
+	return res.Result, nil
+}
+
+// deletes notes together with their cards
+func DeleteNotes(api API, notes []int) error {
+	var res GenericResponse[any]
+
+	params := map[string]any{
+		"notes": notes,
+	}
+
+	if err := api.Request("deleteNotes", params, &res); err != nil {
+		return err
 	}
 
-	return res.Result[0], nil
+	return checkAPIError(res.Error)
 }
 
-// retrieves a specific field value from a card by note ID
-func GetCardField(
-	api API,
-	noteid int,
-	field string,
-) (any, error) {
-	var res GenericResponse[[]map[string]any]
+// suspends cards, they stay in the collection but are no longer reviewed
+func SuspendCards(api API, cards []int) error {
+	var res GenericResponse[bool]
 
 	params := map[string]any{
-		"notes": []int{noteid},
+		"cards": cards,
 	}
 
-	err := api.Request("notesInfo", params, &res)
-	if err != nil {
-		return nil, err
+	if err := api.Request("suspend", params, &res); err != nil {
+		return err
 	}
 
-	if err := checkAPIError(res.Error); err != nil {
-		return nil, err
-	}
+	return checkAPIError(res.Error)
+}
+
+// lists the media files whose name matches a glob pattern
+func GetMediaFilesNames(api API, pattern string) ([]string, error) {
+	var res GenericResponse[[]string]
 
-	if len(res.Result) != 1 {
-		return nil, errors.New("expected exactly one result")
+	params := map[string]any{
+		"pattern": pattern,
 	}
 
-	fields, ok := res.Result[0]["fields"].(map[string]any)
-	if !ok {
-		return nil, errors.New("field not present")
+	if err := api.Request("getMediaFilesNames", params, &res); err != nil {
+		return nil, err
 	}
 
-	v, ok := fields[field].(map[string]any)
-	if !ok {
-		return nil, errors.New("field in invalid format")
+	if err := checkAPIError(res.Error); err != nil {
+		return nil, err
 	}
 
-	return v["value"], nil
+	return res.Result, nil
 }
 
-// UpdateNoteFields updates specific fields of a note identified by its note ID.
-func UpdateNoteFields(
-	api API,
-	noteID int,
-	fields map[string]string, // Generalized to update any fields dynamically
-) (any, error) {
+// CardInfo is the part of a cardsInfo result syncanki uses
+type CardInfo struct {
+	CardID   int `json:"cardId"`
+	Note     int `json:"note"`
+	Interval int `json:"interval"` // in days, negative in seconds while learning
+	Factor   int `json:"factor"`   // ease in permille, 0 for new cards
+	Reps     int `json:"reps"`
+	Lapses   int `json:"lapses"`
+	Queue    int `json:"queue"` // -1 for suspended cards
+}
 
-	// Safety checks
-	if noteID <= 0 {
-		return nil, errors.New("invalid note ID")
-	}
-	if len(fields) == 0 {
-		return nil, errors.New("no fields provided for update")
-	}
+// Review is an entry of the review log of a card
+type Review struct {
+	ID           int `json:"id"`   // time of the review in milliseconds
+	Ease         int `json:"ease"` // button pressed, 1 (again) to 4 (easy), 0 for manual rescheduling
+	Interval     int `json:"ivl"`
+	LastInterval int `json:"lastIvl"`
+	Factor       int `json:"factor"`
+	Time         int `json:"time"` // milliseconds spent answering
+	Type         int `json:"type"` // 0 learn, 1 review, 2 relearn, 3 filtered, 4 manual
+}
+
+// retrieves scheduling information of cards
+func CardsInfo(api API, cards []int) ([]CardInfo, error) {
+	var res GenericResponse[[]CardInfo]
 
-	// Prepare the request payload
 	params := map[string]any{
-		"note": map[string]any{
-			"id":     noteID,
-			"fields": fields, // Dynamic fields input
-		},
+		"cards": cards,
 	}
 
-	// Response struct using the generic response abstraction
-	var res GenericResponse[any]
-	err := api.Request("updateNoteFields", params, &res)
-	if err != nil {
+	if err := api.Request("cardsInfo", params, &res); err != nil {
 		return nil, err
 	}
 
-	// Check if the API returned an error
 	if err := checkAPIError(res.Error); err != nil {
 		return nil, err
 	}
 
-	// Return the result of the update operation
 	return res.Result, nil
 }
 
-// AddCard adds a card to the specified deck with dynamic fields.
-func AddCard(
-	api API,
-	deck string,
-	model string,
-	fields map[string]string, // Generalized to allow any fields
-) (any, error) {
-	// Safety checks
-	if deck == "" {
-		return nil, errors.New("deck name cannot be empty")
-	}
-	if model == "" {
-		return nil, errors.New("model name cannot be empty")
-	}
-	if len(fields) == 0 {
-		return nil, errors.New("no fields provided for the card")
-	}
+// retrieves the review logs of cards, keyed by card id
+func GetReviewsOfCards(api API, cards []int) (map[int][]Review, error) {
+	var res GenericResponse[map[string][]Review]
 
-	// Prepare the request parameters
+	// AnkiConnect expects the card ids as strings
+	ids := make([]string, len(cards))
+	for i, card := range cards {
+		ids[i] = strconv.Itoa(card)
+	}
 	params := map[string]any{
-		"note": map[string]any{
-			"deckName":  deck,
-			"modelName": model,
-			"fields":    fields, // Dynamic fields input
-		},
+		"cards": ids,
 	}
 
-	// Use the GenericResponse struct to capture the response
-	var res GenericResponse[any]
-
-	// Make the API request
-	err := api.Request("addNote", params, &res)
-	if err != nil {
+	if err := api.Request("getReviewsOfCards", params, &res); err != nil {
 		return nil, err
 	}
 
-	// Check for any API error
 	if err := checkAPIError(res.Error); err != nil {
 		return nil, err
 	}
 
-	// Return the result of adding the card
-	return res.Result, nil
+	reviews := make(map[int][]Review, len(res.Result))
+	for id, log := range res.Result {
+		card, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid card id %q in reviews", id)
+		}
+		reviews[card] = log
+	}
+	return reviews, nil
 }
 
-func RemoveCard(
-	api API,
-	id int,
-) error {
+// sends several actions in one request. The responses of the actions are
+// returned in order, an action failing does not stop the others.
+func Multi(api API, actions []Body) ([]GenericResponse[json.RawMessage], error) {
+	var res GenericResponse[[]GenericResponse[json.RawMessage]]
+
 	params := map[string]any{
-		"notes": []int{id},
+		"actions": actions,
 	}
-	var res GenericResponse[any]
-	err := api.Request("deleteNotes", params, &res)
-	if err != nil {
-		return err
+
+	if err := api.Request("multi", params, &res); err != nil {
+		return nil, err
 	}
-	return nil
-}
 
-func StoreMedia(
-	api API,
-	data string,
-	filename string,
-) error {
-	params := map[string]any{"filename": filename, "data": data}
-	var res GenericResponse[string]
+	if err := checkAPIError(res.Error); err != nil {
+		return nil, err
+	}
 
-	err := api.Request("storeMediaFile", params, &res)
-	if err != nil {
-		return err
+	if len(res.Result) != len(actions) {
+		return nil, fmt.Errorf("expected %d results, got %d", len(actions), len(res.Result))
 	}
-	return nil
+
+	return res.Result, nil
 }
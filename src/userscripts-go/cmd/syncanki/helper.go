@@ -1,39 +1,21 @@
 package main
 
 import (
-	"crypto"
+	"context"
 	"encoding/base64"
-	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"reflect"
-	"regexp"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
 )
 
-// Helper function: add a new flashcard to Anki
-func addNewCard(flashcard Flashcard, frontSVG, backSVG string) {
-	// Define fields for the new flashcard
-	fields := map[string]string{
-		"front": frontSVG,
-		"back":  backSVG,
-		"id":    flashcard.ID,
-		"hash":  flashcard.Hash,
-		"fixme": "",
-	}
-
-	// Add the card to the deck
-	_, err := AddCard(&connect, deck, modelName, fields)
-	if err != nil {
-		log.Fatalf("Failed to add new flashcard: %v", err)
-	}
-	log.Printf("Added new flashcard with ID: %s", flashcard.ID)
-}
-
 // Tex2Base64 compiles LaTeX content into a base64-encoded SVG (or PDF) string using temporary files.
-func Tex2Base64(texPath string) (string, error) {
+// Cancelling ctx kills the running process.
+func Tex2Base64(ctx context.Context, texPath string) (string, error) {
 	log.Printf("Compiling %s", texPath)
 
 	// Create a temporary directory
@@ -48,7 +30,8 @@ func Tex2Base64(texPath string) (string, error) {
 	}
 
 	// Compile LaTeX to PDF using latexmk
-	latexmkCmd := exec.Command(
+	latexmkCmd := exec.CommandContext(
+		ctx,
 		"latexmk",
 		"-f",
 		"-pdf",
@@ -67,6 +50,9 @@ func Tex2Base64(texPath string) (string, error) {
 	log.Printf("Trying to write to %s", compiled)
 
 	err = latexmkCmd.Run()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 	if err != nil {
 		// We are in force mode so latexmk is still trying to create the pdf
 		log.Printf("error running latexmk: %v", err)
@@ -78,14 +64,14 @@ func Tex2Base64(texPath string) (string, error) {
 	}
 
 	// Convert the PDF to SVG using pdf2svg
-	pdfcropCmd := exec.Command("pdfcrop", compiled, cropped)
+	pdfcropCmd := exec.CommandContext(ctx, "pdfcrop", compiled, cropped)
 	err = pdfcropCmd.Run()
 	if err != nil {
 		return "", fmt.Errorf("error running pdfcrop: %v", err)
 	}
 
 	// Convert the PDF to SVG using pdf2svg
-	pdf2svgCmd := exec.Command("pdf2svg", cropped, vector)
+	pdf2svgCmd := exec.CommandContext(ctx, "pdf2svg", cropped, vector)
 	err = pdf2svgCmd.Run()
 	if err != nil {
 		return "", fmt.Errorf("error running pdf2svg: %v", err)
@@ -108,45 +94,63 @@ func Tex2Base64(texPath string) (string, error) {
 	return base64SVG, nil
 }
 
-// Helper function: update an existing flashcard in Anki
-func updateCard(cardID int, flashcard Flashcard, frontSVG string, backSVG string) {
-	// Define fields to be updated
-	fields := map[string]string{
-		"front": frontSVG,
-		"back":  backSVG,
-		"hash":  flashcard.Hash,
-	}
+// syncCard queues adding the note of a rendered flashcard, or updating its existing note
+func syncCard(batch *Batch, result RenderResult) {
+	flashcard, note, exists := result.Card, result.Note, result.Exists
 
-	// Update the card
-	noteID, err := Card2Note(&connect, cardID)
-	if err != nil {
-		log.Fatalf("Failed to convert card to note: %v", err)
+	model := cardModel(flashcard)
+	fields := map[string]string{}
+	if len(flashcard.Deletions) > 0 {
+		fields = Cloze2Anki(batch, flashcard, result.Rendered)
+	} else {
+		fields["front"], fields["back"] = Tex2Anki(batch, flashcard, result.Rendered)
 	}
+	fields["hash"] = flashcard.Hash
 
-	_, err = UpdateNoteFields(&connect, noteID, fields)
-	if err != nil {
-		log.Fatalf("Failed to update flashcard: %v", err)
+	// a flashcard that became a cloze card or vice versa needs a note of the other type
+	if exists && note.ModelName != model {
+		log.Printf("Flashcard %s changed its note type, replacing note %d", flashcard.ID, note.NoteID)
+		batch.Add("replace note of "+flashcard.ID, "deleteNotes", map[string]any{"notes": []int{note.NoteID}})
+		exists = false
 	}
-	log.Printf("Updated flashcard with ID: %s", flashcard.ID)
-}
-
-func FindFixme() ([]int, error) {
-	var res GenericResponse[[]int]
 
-	params := map[string]any{
-		"query": fmt.Sprintf("deck:%s fixme:_*", deck),
+	if exists {
+		// Anki adds the cards of new cloze deletions itself, cards of removed
+		// deletions are left empty until "Check Database" cleans them up.
+		batch.Add("update "+flashcard.ID, "updateNoteFields", map[string]any{
+			"note": map[string]any{
+				"id":     note.NoteID,
+				"fields": fields,
+			},
+		})
+		log.Printf("Updating flashcard with ID: %s", flashcard.ID)
+		return
 	}
 
-	err := connect.Request("findCards", params, &res)
-	if err != nil {
-		return []int{}, err
-	}
+	// cards rendered as HTML may have the same front, Anki would reject the
+	// second one as a duplicate
+	fields["id"] = flashcard.ID
+	fields["fixme"] = ""
+	batch.Add("add "+flashcard.ID, "addNote", map[string]any{
+		"note": map[string]any{
+			"deckName":  deck,
+			"modelName": model,
+			"fields":    fields,
+			"options": map[string]any{
+				"allowDuplicate": true,
+				"duplicateScope": "deck",
+			},
+		},
+	})
+	log.Printf("Adding new flashcard with ID: %s", flashcard.ID)
+}
 
-	if err := checkAPIError(res.Error); err != nil {
-		return []int{}, err
+// cardModel returns the note type of a flashcard
+func cardModel(flashcard Flashcard) string {
+	if len(flashcard.Deletions) > 0 {
+		return clozeModelName
 	}
-
-	return res.Result, nil
+	return modelName
 }
 
 // Helper function: check if the deck exists in the list of decks
@@ -159,33 +163,27 @@ func deckExists(decks []string, deck string) bool {
 	return false
 }
 
-func Hash(objs ...interface{}) []byte {
-	digester := crypto.MD5.New()
-	for _, ob := range objs {
-		fmt.Fprint(digester, reflect.TypeOf(ob))
-		fmt.Fprint(digester, ob)
-	}
-	return digester.Sum(nil)
-}
-
-// Card2Zettel finds a file in the given directory that matches the pattern <kastenPath>/*/card_<id>_front.tex
-func Card2Zettel(kastenPath string, cardID string) (string, error) {
-	// Define the pattern for the file search
-	pattern := filepath.Join(kastenPath, "*", fmt.Sprintf("card_%s_front.tex", cardID))
-
-	// Use filepath.Glob to find the matching files
-	matches, err := filepath.Glob(pattern)
+// Card2Zettel returns the directory of the zettel whose manifest lists the flashcard with the given id
+func Card2Zettel(k *kasten.Kasten, cardID string) (string, error) {
+	zettels, err := k.List()
 	if err != nil {
-		return "", err // Return an error if there is an issue with the search
+		return "", err
 	}
 
-	// If no files match the pattern, return an error
-	if len(matches) == 0 {
-		return "", fmt.Errorf("no file found matching card ID %s in %s", cardID, kastenPath)
+	for _, z := range zettels {
+		manifest, err := flashcard.ReadManifest(k.Dir(z))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if manifest.Card(cardID) != nil {
+			return k.Dir(z), nil
+		}
 	}
 
-	// Return the first matching file path
-	return filepath.Dir(matches[0]), nil
+	return "", fmt.Errorf("no zettel defines card ID %s in %s", cardID, k.Root)
 }
 
 func InsertFixme(zettelPath string, cardID string, fix string) error {
@@ -208,45 +206,18 @@ func InsertFixme(zettelPath string, cardID string, fix string) error {
 	return nil
 }
 
-// findFlashcards is a helper function to find flashcards in a given Zettel path
-func findFlashcards(zettelPath string) ([]Flashcard, error) {
+// findFlashcards is a helper function to find the card files listed in the manifest of a Zettel path
+func findFlashcards(zettelPath string, manifest flashcard.Manifest) ([]Flashcard, error) {
 	// Slice to store flashcards
 	var flashcards []Flashcard
 
-	// Regular expressions for card front and back file names (ID can be alphanumeric)
-	frontPattern := regexp.MustCompile(`card_([a-zA-Z0-9]+)_front\.tex`)
-	backPattern := regexp.MustCompile(`card_([a-zA-Z0-9]+)_back\.tex`)
-
-	// Maps to hold matched files (keyed by card ID)
-	frontFiles := make(map[string]string)
-	backFiles := make(map[string]string)
-
-	// List all files in the zettelPath directory
-	files, err := os.ReadDir(zettelPath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read directory: %v", err)
-	}
-
-	// Iterate over files in the directory and match patterns
-	for _, file := range files {
-		fileName := file.Name()
-
-		// Match the front card pattern
-		if matches := frontPattern.FindStringSubmatch(fileName); matches != nil {
-			cardID := matches[1]
-			frontFiles[cardID] = filepath.Join(zettelPath, fileName)
-		}
-
-		// Match the back card pattern
-		if matches := backPattern.FindStringSubmatch(fileName); matches != nil {
-			cardID := matches[1]
-			backFiles[cardID] = filepath.Join(zettelPath, fileName)
+	for _, card := range manifest.Cards {
+		id := card.ID
+		if !flashcard.IDPattern.MatchString(id) {
+			log.Printf("Invalid card ID %q. Skipping card.\n", id)
+			continue
 		}
-	}
 
-	// Now check if both front and back files exist for every ID
-	// and the card has no fixme file.
-	for id, frontPath := range frontFiles {
 		// Check if card has a fixme file
 		fixmePath := fmt.Sprintf("%s/fix_%s", zettelPath, id)
 		_, err := os.Stat(fixmePath)
@@ -255,37 +226,97 @@ func findFlashcards(zettelPath string) ([]Flashcard, error) {
 			continue
 		}
 
-		// Check that both front and back files exist
-		backPath, exists := backFiles[id]
-		if !exists {
-			log.Printf("Missing back file for card ID %s. Skipping card.\n", id)
-			continue
+		// Read content from the front and back files of every deletion
+		var files []flashcard.CardFiles
+		var fronts, backs [][]byte
+		for _, f := range card.Files {
+			if f.Front != filepath.Base(f.Front) || f.Back != filepath.Base(f.Back) {
+				log.Printf("Card files of card ID %s are outside of the zettel. Skipping card.\n", id)
+				break
+			}
+			front := filepath.Join(zettelPath, f.Front)
+			back := filepath.Join(zettelPath, f.Back)
+
+			frontContent, err := os.ReadFile(front)
+			if err != nil {
+				log.Printf("Error reading front file for card ID %s: %v. Skipping card.\n", id, err)
+				break
+			}
+			backContent, err := os.ReadFile(back)
+			if err != nil {
+				log.Printf("Error reading back file for card ID %s: %v. Skipping card.\n", id, err)
+				break
+			}
+			files = append(files, flashcard.CardFiles{Front: front, Back: back})
+			fronts = append(fronts, frontContent)
+			backs = append(backs, backContent)
 		}
-
-		// Read content from the front and back files
-		frontContent, err := os.ReadFile(frontPath)
-		if err != nil {
-			log.Printf("Error reading front file for card ID %s: %v. Skipping card.\n", id, err)
+		if len(files) == 0 || len(files) != len(card.Files) {
 			continue
 		}
 
-		backContent, err := os.ReadFile(backPath)
-		if err != nil {
-			log.Printf("Error reading back file for card ID %s: %v. Skipping card.\n", id, err)
-			continue
+		// Create a new Flashcard instance and append it to the flashcards slice
+		fc := Flashcard{
+			ID:   id,
+			Hash: flashcard.HashSides(fronts, backs),
+		}
+		if card.Kind == flashcard.KindCloze {
+			fc.Deletions = files
+		} else {
+			fc.Front = files[0].Front
+			fc.Back = files[0].Back
 		}
 
-		hash := hex.EncodeToString(Hash(frontContent, backContent))
-
-		// Create a new Flashcard instance and append it to the flashcards slice
-		flashcards = append(flashcards, Flashcard{
-			ID:    id,
-			Front: string(frontPath),
-			Back:  string(backPath),
-			Hash:  string(hash),
-		})
+		// HTML cards are fingerprinted by their HTML, so switching the render mode updates the note
+		mode := card.Render
+		if mode == "" {
+			mode = renderMode
+		}
+		if mode == flashcard.RenderHTML {
+			if htmlFronts, htmlBacks, ok := readHTML(zettelPath, card); ok {
+				fc.HTMLFronts, fc.HTMLBacks = htmlFronts, htmlBacks
+				fc.Hash = flashcard.HashSides(toBytes(htmlFronts), toBytes(htmlBacks))
+			} else {
+				log.Printf("Card %s has no HTML translation, rendering it as SVG", id)
+			}
+		}
+		flashcards = append(flashcards, fc)
 	}
 
 	// Return the list of flashcards
 	return flashcards, nil
 }
+
+// readHTML reads the HTML translations of the sides of a card
+func readHTML(zettelPath string, card flashcard.ManifestCard) ([]string, []string, bool) {
+	if len(card.HTML) == 0 || len(card.HTML) != len(card.Files) {
+		return nil, nil, false
+	}
+
+	var fronts, backs []string
+	for _, f := range card.HTML {
+		if f.Front != filepath.Base(f.Front) || f.Back != filepath.Base(f.Back) {
+			return nil, nil, false
+		}
+		front, err := os.ReadFile(filepath.Join(zettelPath, f.Front))
+		if err != nil {
+			return nil, nil, false
+		}
+		back, err := os.ReadFile(filepath.Join(zettelPath, f.Back))
+		if err != nil {
+			return nil, nil, false
+		}
+		fronts = append(fronts, string(front))
+		backs = append(backs, string(back))
+	}
+	return fronts, backs, true
+}
+
+// toBytes converts strings for hashing
+func toBytes(sides []string) [][]byte {
+	b := make([][]byte, len(sides))
+	for i, side := range sides {
+		b[i] = []byte(side)
+	}
+	return b
+}
@@ -1,17 +1,45 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
-	"xk/src/userscripts-go/pkg/api"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/rendercache"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
 )
 
-// the Anki-Connect API
-var url, _ = os.LookupEnv("ANKI_CONNECT_URL")
-var deck, _ = os.LookupEnv("ANKI_DECK_NAME")
-var modelName, _ = os.LookupEnv("ANKI_MODEL_NAME")
-var connect = AnkiConnect{Url: url}
+// the Anki-Connect API and the deck and note types the cards are synced to, set by useAnki
+var (
+	connect        API
+	deck           string
+	modelName      string
+	clozeModelName string
+)
+
+// useAnki points syncanki at a collection, a deck and the note types of
+// flashcards and cloze cards. It returns a function restoring the previous ones.
+func useAnki(api API, deckName, model, clozeModel string) (restore func()) {
+	oldConnect, oldDeck, oldModel, oldCloze := connect, deck, modelName, clozeModelName
+	connect, deck, modelName, clozeModelName = api, deckName, model, clozeModel
+	return func() {
+		connect, deck, modelName, clozeModelName = oldConnect, oldDeck, oldModel, oldCloze
+	}
+}
+
+// renderMode is how cards appear in Anki unless they choose themselves, flashcard.RenderSVG or flashcard.RenderHTML
+var renderMode = os.Getenv("ANKI_RENDER_MODE")
 
 // Flashcard structure, representing front, back, id, hash
 type Flashcard struct {
@@ -19,211 +47,365 @@ type Flashcard struct {
 	Back  string
 	ID    string
 	Hash  string
+
+	// the card files of every deletion, only set for cloze cards
+	Deletions []flashcard.CardFiles
+
+	// the HTML of the sides of every deletion, only set for cards rendered as HTML
+	HTMLFronts []string
+	HTMLBacks  []string
 }
 
-func Tex2Anki(flashcard Flashcard) (string, string, error) {
-	frontFilenameAnki := fmt.Sprintf("%s_front.svg", flashcard.ID)
-	backFilenameAnki := fmt.Sprintf("%s_back.svg", flashcard.ID)
+// maxDeletions is the number of deletions per cloze card the cloze note type can display
+const maxDeletions = 100
+
+// clozeCSS shows only the images or HTML of the deletion a card is about.
+// Anki marks the card of the n-th deletion with the class cardn.
+func clozeCSS() string {
+	var css strings.Builder
+	css.WriteString(".card { text-align: center; }\n")
+	css.WriteString(".deletion { display: none; }\n")
+	for n := 1; n <= maxDeletions; n++ {
+		fmt.Fprintf(&css, ".card%d .deletion%d { display: inline; }\n", n, n)
+	}
+	return css.String()
+}
+
+// Tex2Anki queues storing the rendered sides of a flashcard as media files and returns the front and back fields.
+// The fields of a card rendered as HTML are its HTML.
+func Tex2Anki(batch *Batch, flashcard Flashcard, rendered Rendered) (string, string) {
+	if flashcard.HTMLFronts != nil {
+		return flashcard.HTMLFronts[0], flashcard.HTMLBacks[0]
+	}
+
+	frontFilenameAnki := MediaFilename(flashcard.ID, "front", rendered.Fronts[0])
+	backFilenameAnki := MediaFilename(flashcard.ID, "back", rendered.Backs[0])
 
 	frontHtml := fmt.Sprintf("<img src=%s>", frontFilenameAnki)
 	backHtml := fmt.Sprintf("<img src=%s>", backFilenameAnki)
 
-	// Compile LaTex
-	frontSVG, err := Tex2Base64(flashcard.Front)
-	if err != nil {
-		return "", "", err
+	// Store SVG in Anki
+	QueueMedia(batch, rendered.Fronts[0], frontFilenameAnki)
+	QueueMedia(batch, rendered.Backs[0], backFilenameAnki)
+
+	return frontHtml, backHtml
+}
+
+// Cloze2Anki queues storing the rendered deletions of a cloze card as media
+// files and returns the text, front and back fields of its note. Cards
+// rendered as HTML need no media files.
+func Cloze2Anki(batch *Batch, card Flashcard, rendered Rendered) map[string]string {
+	var text, front, back strings.Builder
+	for i := range card.Deletions {
+		n := i + 1
+
+		// one cloze per deletion makes Anki create a card for it
+		fmt.Fprintf(&text, "{{c%d::%d}} ", n, n)
+
+		if card.HTMLFronts != nil {
+			fmt.Fprintf(&front, "<span class=\"deletion deletion%d\">%s</span>", n, card.HTMLFronts[i])
+			fmt.Fprintf(&back, "<span class=\"deletion deletion%d\">%s</span>", n, card.HTMLBacks[i])
+			continue
+		}
+
+		frontFilenameAnki := MediaFilename(card.ID, fmt.Sprintf("%d_front", n), rendered.Fronts[i])
+		backFilenameAnki := MediaFilename(card.ID, fmt.Sprintf("%d_back", n), rendered.Backs[i])
+
+		// Store SVG in Anki
+		QueueMedia(batch, rendered.Fronts[i], frontFilenameAnki)
+		QueueMedia(batch, rendered.Backs[i], backFilenameAnki)
+
+		fmt.Fprintf(&front, "<img class=\"deletion deletion%d\" src=%s>", n, frontFilenameAnki)
+		fmt.Fprintf(&back, "<img class=\"deletion deletion%d\" src=%s>", n, backFilenameAnki)
 	}
-	backSVG, err := Tex2Base64(flashcard.Back)
-	if err != nil {
-		return "", "", err
+
+	return map[string]string{
+		"text":  text.String(),
+		"front": front.String(),
+		"back":  back.String(),
 	}
+}
 
-	// Store SVG in Anki
-	err = StoreMedia(&connect, frontSVG, frontFilenameAnki)
+// processZettel retrieves the Zettel path, compares its flashcards with the
+// notes in the index and returns the new and changed ones
+func processZettel(k *kasten.Kasten, c *cache.Cache, p *cache.Parser, index Index, zettel string) ([]RenderJob, error) {
+	// Retrieve the Zettel's path
+	zettelPath, err := k.Path(zettel)
 	if err != nil {
-		return "", "", err
+		log.Fatalf("Unable to retrieve path for zettel '%s': %v", zettel, err)
 	}
-	err = StoreMedia(&connect, backSVG, backFilenameAnki)
+
+	// The parse cache knows which zettels define flashcards
+	entry, err := c.Entry(p, zettel)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+	if len(entry.Cards) == 0 {
+		return nil, nil
 	}
-
-	return frontHtml, backHtml, nil
-}
-
-// processZettel retrieves the Zettel path and handles the retrieval and comparison of multiple flashcards
-func processZettel(zettel string) error {
 	log.Printf("Processing zettel %s", zettel)
 
-	// Retrieve the Zettel's path using api.Xk("path")
-	zettelPaths, err := api.Xk("path", map[string]string{"z": zettel})
-	if err != nil {
-		log.Fatalf("Unable to retrieve path for zettel '%s': %v", zettel, err)
+	// gencards lists the card files in the manifest
+	manifest, err := flashcard.ReadManifest(zettelPath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Zettel %s has no %s, run gencards first", zettel, flashcard.ManifestFilename)
+		return nil, nil
 	}
-
-	// Assuming api.Xk returns a list of strings and we take the first element
-	if len(zettelPaths) == 0 {
-		log.Fatalf("No path found for zettel '%s'", zettel)
+	if err != nil {
+		return nil, err
 	}
-	zettelPath := zettelPaths[0]
 
 	// Continue with processing flashcards in the zettel path
-	flashcards, err := findFlashcards(zettelPath)
+	flashcards, err := findFlashcards(zettelPath, manifest)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	var jobs []RenderJob
 	for _, flashcard := range flashcards {
-		// Search for the card in Anki by its ID
-		log.Printf("---%s---", flashcard.ID)
-		ankiID, err := FindCard(&connect, deck, flashcard.ID)
-
-		if ankiID != -1 || err != nil {
-			log.Printf("Found Flashard %s in anki: %d", flashcard.ID, ankiID)
-			noteID, err := Card2Note(&connect, ankiID)
-			if err != nil {
-				log.Printf("Failed to get note of card %d", ankiID)
-				continue
-			}
-			cardHash, err := GetCardField(&connect, noteID, "hash")
-			if err != nil {
-				log.Printf("Failed to get hash from note %d. Updating card.", noteID)
-				cardHash = ""
-			}
-
-			log.Printf("Hash in Anki: %s, current hash: %s", cardHash, flashcard.Hash)
-			if flashcard.Hash == cardHash {
+		note, exists := index[flashcard.ID]
+		if exists {
+			log.Printf("Hash in Anki: %s, current hash: %s", note.Field("hash"), flashcard.Hash)
+			if note.Field("hash") == flashcard.Hash {
 				log.Printf("Flashcard %s unchanged, skipping update", flashcard.ID)
 				continue
 			}
-			front, back, err := Tex2Anki(flashcard)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			updateCard(ankiID, flashcard, front, back)
-			continue
 		}
 
-		log.Println("Flashcard does not exist. Creating it.")
-		front, back, err := Tex2Anki(flashcard)
+		jobs = append(jobs, RenderJob{Card: flashcard, Note: note, Exists: exists})
+	}
+	return jobs, nil
+}
+
+// ensureDeck creates the deck and the note types unless they exist
+func ensureDeck() error {
+	decks, err := GetDecks(connect)
+	if err != nil {
+		return err
+	}
+
+	// If deck does not exist, create it
+	if !deckExists(decks, deck) {
+		_, err := CreateDeck(connect, deck)
 		if err != nil {
-			log.Println(err)
-			continue
+			return fmt.Errorf("failed to create deck: %v", err)
 		}
-		addNewCard(flashcard, front, back)
 	}
+
+	// If model does not exist, create it
+	fields := []string{"front", "back", "id", "hash", "fixme"}
+	template := []map[string]string{
+		{
+			"Front": "{{front}}",
+			"Back":  "{{back}}",
+		},
+	}
+
+	CreateModel(
+		connect,
+		modelName,
+		fields,
+		template,
+		false,
+		"",
+	)
+
+	// The cloze note type generates a card per deletion from the text field,
+	// which is hidden. Only the images of the card's deletion are shown.
+	clozeFields := []string{"id", "text", "front", "back", "hash", "fixme"}
+	clozeTemplate := []map[string]string{
+		{
+			"Front": "<div hidden>{{cloze:text}}</div>{{front}}",
+			"Back":  "<div hidden>{{cloze:text}}</div>{{back}}",
+		},
+	}
+
+	CreateModel(
+		connect,
+		clozeModelName,
+		clozeFields,
+		clozeTemplate,
+		true,
+		clozeCSS(),
+	)
 	return nil
 }
 
 // Main function
 func main() {
-	// find cards to fix
-	pathResp, err := api.Xk("path", map[string]string{})
-	if err != nil {
-		log.Println("Unable to retrieve zettel kasten path.")
-		os.Exit(1)
+	flag.Usage = func() {
+		out := flag.CommandLine.Output()
+		fmt.Fprintf(out, "Usage: %s [plan|apply PLAN|stats] [flags]\n", os.Args[0])
+		fmt.Fprintln(out, "  (none)      sync the cards of the kasten to Anki")
+		fmt.Fprintln(out, "  plan        list the changes a sync would make without making them")
+		fmt.Fprintln(out, "  apply PLAN  make the changes of a plan saved with plan -o or plan -json")
+		fmt.Fprintf(out, "  stats       write the review statistics of the cards into %s files and report the hardest zettels\n", StatsFilename)
+		flag.PrintDefaults()
+	}
+	suspend := flag.Bool("suspend-instead", false, "Suspend the notes of deleted cards instead of deleting them")
+	dryRun := flag.Bool("dry-run", false, "Only list the notes the prune phase would delete or suspend")
+	workers := flag.Int("j", runtime.NumCPU(), "Number of flashcards rendered concurrently")
+	renderCacheSize := flag.Int64("render-cache-size", 512, "Size limit of the render cache in MiB")
+	asJSON := flag.Bool("json", false, "Print the plan or the statistics as JSON (plan and stats only)")
+	output := flag.String("o", "", "Also save the plan as JSON to this file (plan only)")
+
+	command := "sync"
+	args := os.Args[1:]
+	if len(args) > 0 && (args[0] == "plan" || args[0] == "apply" || args[0] == "stats") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	wantArgs := 0
+	if command == "apply" {
+		wantArgs = 1
+	}
+	if flag.NArg() != wantArgs {
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	// get the note ids of flashcards to fix
-	cardsToFix, err := FindFixme()
+	useAnki(&AnkiConnect{Url: os.Getenv("ANKI_CONNECT_URL")},
+		os.Getenv("ANKI_DECK_NAME"), os.Getenv("ANKI_MODEL_NAME"), os.Getenv("ANKI_CLOZE_MODEL_NAME"))
+
+	if renderMode != "" && renderMode != flashcard.RenderSVG && renderMode != flashcard.RenderHTML {
+		log.Fatalf("Unknown ANKI_RENDER_MODE %q, use %s or %s", renderMode, flashcard.RenderSVG, flashcard.RenderHTML)
+	}
+
+	// Interrupting the sync stops rendering, the rendered cards are still sent to Anki
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	k, err := kasten.FromEnv()
 	if err != nil {
-		log.Println("Unable to retrieve flashcards to fix.")
+		log.Printf("Unable to open zettel kasten: %v", err)
 		os.Exit(1)
 	}
 
-	for _, card := range cardsToFix {
-		log.Printf("Card %d needs to be fixed\n", card)
+	if command == "stats" {
+		report, err := CollectStats(connect, k)
+		if err != nil {
+			log.Fatalf("Unable to retrieve review statistics: %v", err)
+		}
+		if err := WriteZettelStats(k, report); err != nil {
+			log.Fatalf("Error writing review statistics: %v", err)
+		}
+		path, err := SaveStats(k, report)
+		if err != nil {
+			log.Fatalf("Error saving review statistics: %v", err)
+		}
+		log.Printf("Saved the report to %s", path)
 
-		noteID, err := Card2Note(&connect, card)
+		if *asJSON {
+			err = WriteStats(os.Stdout, report)
+		} else {
+			err = WriteStatsTable(os.Stdout, report)
+		}
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatalf("Error writing review statistics: %v", err)
 		}
+		return
+	}
 
-		defer RemoveCard(&connect, noteID)
+	parseCache, err := cache.Open(k)
+	if err != nil {
+		log.Fatalf("Unable to open parse cache: %v", err)
+	}
+	parser, err := cache.NewParser(sitter.NewLanguage(treesitter.Language()))
+	if err != nil {
+		log.Fatalf("Unable to compile reference query: %v", err)
+	}
+	defer parser.Close()
 
-		cardID, err := GetCardField(&connect, noteID, "id")
+	if *dryRun {
+		obsolete, err := obsoleteNotes(k, parseCache, parser, *suspend)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatalf("Unable to find obsolete notes: %v", err)
 		}
-		cardIDstring, ok := cardID.(string)
-		if !ok {
-			log.Println("Invalid ID type. Skipping")
-			continue
+		ListObsoleteNotes(os.Stdout, obsolete, *suspend)
+		if err := parseCache.Save(); err != nil {
+			log.Printf("Error saving parse cache: %v", err)
 		}
+		return
+	}
 
-		fixme, err := GetCardField(&connect, noteID, "fixme")
+	// fetch the ids, hashes and fixmes of all notes at once
+	index, err := LoadIndex(connect)
+	if err != nil {
+		log.Fatalf("Unable to retrieve notes: %v", err)
+	}
+
+	var plan Plan
+	if command == "apply" {
+		plan, err = ReadPlan(flag.Arg(0))
 		if err != nil {
-			log.Println("Unable to get cards fixme. Skipping")
-			continue
+			log.Fatalf("Unable to read plan: %v", err)
 		}
-		fixmeString, ok := fixme.(string)
-		if !ok {
-			log.Println("fixme of invalid type. Skipping")
-			continue
+		// a plan is applied exactly as it was shown, or not at all
+		if stale := CheckPlan(k, parseCache, parser, plan, index); len(stale) > 0 {
+			for _, err := range stale {
+				log.Println(err)
+			}
+			log.Fatalf("The plan is out of date, run %s plan again", os.Args[0])
 		}
-
-		// Find the Zettel the card originated from
-		originZettel, err := Card2Zettel(pathResp[0], cardIDstring)
+	} else {
+		plan, err = BuildPlan(k, parseCache, parser, index, *suspend)
 		if err != nil {
-			log.Println("Unable to find origin zettel. Skipping")
-			continue
+			log.Fatalf("Unable to plan the sync: %v", err)
 		}
-		log.Printf("Found it in zettel %s.\n", originZettel)
+	}
+
+	if err := parseCache.Save(); err != nil {
+		log.Printf("Error saving parse cache: %v", err)
+	}
 
-		err = InsertFixme(originZettel, cardIDstring, fixmeString)
+	if command == "plan" {
+		if *output != "" {
+			file, err := os.Create(*output)
+			if err != nil {
+				log.Fatalf("Error creating plan file: %v", err)
+			}
+			err = WritePlan(file, plan)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				log.Fatalf("Error saving plan: %v", err)
+			}
+		}
+
+		if *asJSON {
+			err = WritePlan(os.Stdout, plan)
+		} else {
+			err = WritePlanTable(os.Stdout, plan)
+		}
 		if err != nil {
-			log.Println("Error during fixing: ")
-			log.Print(err)
+			log.Fatalf("Error writing plan: %v", err)
 		}
+		return
 	}
+	log.Printf("Plan: %s", plan.Summary())
 
-	zettels, err := api.Xk("ls", map[string]string{})
+	// Cards rendered before, e.g. for another Anki profile, come from the render cache
+	renders, err := rendercache.Open(k)
 	if err != nil {
-		log.Println("Unable to retrieve zettels.")
-		os.Exit(1)
+		log.Printf("Rendering without cache: %v", err)
 	}
 
-	if len(zettels) == 0 {
-		log.Println("No zettels found.")
-		os.Exit(1)
-	}
-
-	// if the deck does not exist, create it
-	decks, err := GetDecks(&connect)
-	if err != nil {
-		log.Fatal(err)
+	failed := ApplyPlan(ctx, k, renders, plan, index, *workers)
+	for _, err := range failed {
+		log.Println(err)
 	}
-	log.Println(decks)
 
-	// If deck does not exist, create it
-	if !deckExists(decks, deck) {
-		_, err := CreateDeck(&connect, deck)
+	if renders != nil {
+		removed, err := renders.GC(*renderCacheSize << 20)
 		if err != nil {
-			log.Fatalf("Failed to create deck: %v", err)
+			log.Printf("Error cleaning up render cache: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d renderings from the render cache", removed)
 		}
 	}
 
-	// If model does not exist, create it
-	fields := []string{"front", "back", "id", "hash", "fixme"}
-	template := []map[string]string{
-		{
-			"Front": "{{front}}",
-			"Back":  "{{back}}",
-		},
-	}
-
-	CreateModel(
-		&connect,
-		modelName,
-		fields,
-		template,
-	)
-
-	// Process each zettel
-	for _, z := range zettels {
-		processZettel(z)
+	if len(failed) > 0 {
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// mediaPrefix starts the names of the media files syncanki stores
+const mediaPrefix = "xk_"
+
+// MediaFilename names a rendered side of a card after the card id and the
+// file content. A changed side gets a new name, so Anki and AnkiWeb never
+// show a cached older version of it.
+func MediaFilename(cardID, side, data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return fmt.Sprintf("%s%s_%s_%s.svg", mediaPrefix, cardID, hex.EncodeToString(sum[:8]), side)
+}
+
+// legacyMediaPattern matches the names media files had before they were
+// versioned, <id>_front.svg or <id>_<n>_front.svg
+var legacyMediaPattern = regexp.MustCompile(`^([a-zA-Z0-9]+)_(?:[0-9]+_)?(?:front|back)\.svg$`)
+
+// srcPattern finds the media files an HTML field refers to
+var srcPattern = regexp.MustCompile(`src="?([^"\s>]+)`)
+
+// isOwnedMedia reports whether syncanki stored a media file. Files with a
+// legacy name only count if their card id belongs to a note of the xk note
+// types, other files of the collection may look alike.
+func isOwnedMedia(name string, cardIDs map[string]bool) bool {
+	if strings.HasPrefix(name, mediaPrefix) && strings.HasSuffix(name, ".svg") {
+		return true
+	}
+	m := legacyMediaPattern.FindStringSubmatch(name)
+	return m != nil && cardIDs[m[1]]
+}
+
+// CleanupMedia deletes the media files stored by syncanki that no note of the
+// xk note types refers to any more, in any deck. The card ids of the notes
+// deleted in the same run are passed as deleted, so the files with a legacy
+// name of those notes go too. It returns the number of deleted files.
+func CleanupMedia(api API, deleted []string) (int, error) {
+	noteIDs, err := FindNotes(api, searchTerm("note", modelName)+" OR "+searchTerm("note", clozeModelName))
+	if err != nil {
+		return 0, err
+	}
+	var notes []NoteInfo
+	if len(noteIDs) > 0 {
+		notes, err = NotesInfo(api, noteIDs)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	referenced := map[string]bool{}
+	cardIDs := map[string]bool{}
+	for _, id := range deleted {
+		cardIDs[id] = true
+	}
+	for _, note := range notes {
+		cardIDs[note.Field("id")] = true
+		for _, field := range note.Fields {
+			for _, m := range srcPattern.FindAllStringSubmatch(field.Value, -1) {
+				referenced[m[1]] = true
+			}
+		}
+	}
+
+	names, err := GetMediaFilesNames(api, "*.svg")
+	if err != nil {
+		return 0, err
+	}
+
+	batch := NewBatch(api)
+	removed := 0
+	for _, name := range names {
+		if referenced[name] || !isOwnedMedia(name, cardIDs) {
+			continue
+		}
+		batch.Add("delete "+name, "deleteMediaFile", map[string]any{"filename": name})
+		removed++
+	}
+	batch.Flush()
+
+	errs := batch.Errors()
+	for _, err := range errs {
+		log.Println(err)
+	}
+	if len(errs) > 0 {
+		return removed - len(errs), fmt.Errorf("failed to delete %d media files", len(errs))
+	}
+	return removed, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/rendercache"
+)
+
+// Operations of a plan
+const (
+	OpFix     = "fix"     // store the fixme of a note next to its card and delete the note
+	OpCreate  = "create"  // add a note for a new card
+	OpUpdate  = "update"  // update the fields of the note of a changed card
+	OpReplace = "replace" // a card turned from basic into cloze or back, its note is deleted and added again
+	OpDelete  = "delete"  // delete the note of a card that no longer exists
+	OpSuspend = "suspend" // suspend the cards of a note whose card no longer exists
+)
+
+// Plan lists everything a sync changes in the deck, in the order it is done
+type Plan struct {
+	Deck       string       `json:"deck"`
+	Model      string       `json:"model"`
+	ClozeModel string       `json:"clozeModel"`
+	Actions    []PlanAction `json:"actions"`
+}
+
+// PlanAction is a change to a single note
+type PlanAction struct {
+	Op      string `json:"op"`
+	CardID  string `json:"card"`
+	Zettel  string `json:"zettel,omitempty"` // the zettel defining the card, unset for delete and suspend
+	NoteID  int    `json:"note,omitempty"`   // the existing note, unset for create
+	OldHash string `json:"oldHash,omitempty"`
+	NewHash string `json:"newHash,omitempty"`
+	Fixme   string `json:"fixme,omitempty"`
+}
+
+// BuildPlan compares the cards of the kasten with the notes in the index and
+// lists the changes needed to bring the deck up to date. Nothing is rendered
+// or written.
+func BuildPlan(k *kasten.Kasten, c *cache.Cache, p *cache.Parser, index Index, suspend bool) (Plan, error) {
+	plan := Plan{Deck: deck, Model: modelName, ClozeModel: clozeModelName}
+
+	zettels, err := k.List()
+	if err != nil {
+		return plan, err
+	}
+	if len(zettels) == 0 {
+		return plan, fmt.Errorf("no zettels found in %s", k.Root)
+	}
+
+	// notes with a fixme are removed once the fixme is stored next to the card
+	ids := make([]string, 0, len(index))
+	for id := range index {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	fixed := map[string]bool{}
+	for _, cardID := range ids {
+		note := index[cardID]
+		fixme := note.Field("fixme")
+		if fixme == "" {
+			continue
+		}
+		log.Printf("Card %s needs to be fixed\n", cardID)
+
+		// Find the Zettel the card originated from
+		originZettel, err := Card2Zettel(k, cardID)
+		if err != nil {
+			log.Println("Unable to find origin zettel. Skipping")
+			continue
+		}
+
+		plan.Actions = append(plan.Actions, PlanAction{
+			Op:     OpFix,
+			CardID: cardID,
+			Zettel: filepath.Base(originZettel),
+			NoteID: note.NoteID,
+			Fixme:  fixme,
+		})
+		fixed[cardID] = true
+	}
+
+	// Collect the new and changed flashcards of each zettel
+	for _, z := range zettels {
+		jobs, err := processZettel(k, c, p, index, z)
+		if err != nil {
+			log.Printf("Error processing zettel %s: %v", z, err)
+		}
+		for _, job := range jobs {
+			action := PlanAction{Op: OpCreate, CardID: job.Card.ID, Zettel: z, NewHash: job.Card.Hash}
+			if job.Exists {
+				// the note of a fixed card is deleted anyway
+				if fixed[job.Card.ID] {
+					continue
+				}
+				action.Op = OpUpdate
+				if job.Note.ModelName != cardModel(job.Card) {
+					action.Op = OpReplace
+				}
+				action.NoteID = job.Note.NoteID
+				action.OldHash = job.Note.Field("hash")
+			}
+			plan.Actions = append(plan.Actions, action)
+		}
+	}
+
+	// Remove the notes of cards that were deleted from the kasten
+	obsolete, err := obsoleteNotes(k, c, p, suspend)
+	if err != nil {
+		return plan, err
+	}
+	op := OpDelete
+	if suspend {
+		op = OpSuspend
+	}
+	for _, note := range obsolete {
+		plan.Actions = append(plan.Actions, PlanAction{
+			Op:      op,
+			CardID:  note.Field("id"),
+			NoteID:  note.NoteID,
+			OldHash: note.Field("hash"),
+		})
+	}
+
+	return plan, nil
+}
+
+// CheckPlan reports every action of a saved plan whose card or note changed
+// since the plan was made. A plan is only applied if nothing changed.
+func CheckPlan(k *kasten.Kasten, c *cache.Cache, p *cache.Parser, plan Plan, index Index) []error {
+	if plan.Deck != deck || plan.Model != modelName || plan.ClozeModel != clozeModelName {
+		return []error{fmt.Errorf("plan was made for deck %s with note types %s and %s",
+			plan.Deck, plan.Model, plan.ClozeModel)}
+	}
+
+	_, stale := planJobs(k, plan, index)
+
+	var pruned []int
+	for _, action := range plan.Actions {
+		note, exists := index[action.CardID]
+		switch action.Op {
+		case OpCreate:
+			if exists {
+				stale = append(stale, fmt.Errorf("%s: a note was added to the deck", action.CardID))
+			}
+		case OpUpdate, OpReplace:
+			if !exists || note.NoteID != action.NoteID || note.Field("hash") != action.OldHash {
+				stale = append(stale, fmt.Errorf("%s: note %d changed in the deck", action.CardID, action.NoteID))
+			}
+		case OpFix:
+			if !exists || note.NoteID != action.NoteID || note.Field("fixme") != action.Fixme {
+				stale = append(stale, fmt.Errorf("%s: the fixme of note %d changed", action.CardID, action.NoteID))
+			}
+		case OpDelete, OpSuspend:
+			pruned = append(pruned, action.NoteID)
+		default:
+			stale = append(stale, fmt.Errorf("%s: unknown operation %q", action.CardID, action.Op))
+		}
+	}
+	if len(pruned) == 0 {
+		return stale
+	}
+
+	// pruned notes must still exist and their cards must still be gone
+	present, broken, err := PresentIDs(k, c, p)
+	if err != nil {
+		return append(stale, err)
+	}
+	for _, z := range broken {
+		stale = append(stale, fmt.Errorf("zettel %s has syntax errors, its cards may be missing", z))
+	}
+	notes, err := NotesInfo(connect, pruned)
+	if err != nil {
+		return append(stale, err)
+	}
+	i := 0
+	for _, action := range plan.Actions {
+		if action.Op != OpDelete && action.Op != OpSuspend {
+			continue
+		}
+		// notesInfo answers in request order, with an empty note for a missing one
+		var note NoteInfo
+		if i < len(notes) {
+			note = notes[i]
+		}
+		i++
+		if note.NoteID != action.NoteID || note.Field("id") != action.CardID {
+			stale = append(stale, fmt.Errorf("%s: note %d no longer exists", action.CardID, action.NoteID))
+		} else if present[action.CardID] {
+			stale = append(stale, fmt.Errorf("%s: the card was added to the kasten again", action.CardID))
+		}
+	}
+	return stale
+}
+
+// planJobs finds the cards to create, update and replace in their zettels.
+// Cards whose hash differs from the plan are reported instead.
+func planJobs(k *kasten.Kasten, plan Plan, index Index) ([]RenderJob, []error) {
+	var jobs []RenderJob
+	var stale []error
+	cards := map[string][]Flashcard{}
+	for _, action := range plan.Actions {
+		if action.Op != OpCreate && action.Op != OpUpdate && action.Op != OpReplace {
+			continue
+		}
+
+		flashcards, ok := cards[action.Zettel]
+		if !ok {
+			var err error
+			flashcards, err = zettelFlashcards(k, action.Zettel)
+			if err != nil {
+				stale = append(stale, fmt.Errorf("%s: %v", action.CardID, err))
+			}
+			cards[action.Zettel] = flashcards
+		}
+
+		found := false
+		for _, card := range flashcards {
+			if card.ID != action.CardID {
+				continue
+			}
+			found = true
+			if card.Hash != action.NewHash {
+				stale = append(stale, fmt.Errorf("%s: the card changed in zettel %s", action.CardID, action.Zettel))
+				break
+			}
+			note, exists := index[card.ID]
+			jobs = append(jobs, RenderJob{Card: card, Note: note, Exists: exists && action.Op != OpCreate})
+			break
+		}
+		if !found {
+			stale = append(stale, fmt.Errorf("%s: zettel %s no longer defines the card", action.CardID, action.Zettel))
+		}
+	}
+	return jobs, stale
+}
+
+// zettelFlashcards reads the flashcards listed in the manifest of a zettel
+func zettelFlashcards(k *kasten.Kasten, zettel string) ([]Flashcard, error) {
+	zettelPath, err := k.Path(zettel)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := flashcard.ReadManifest(zettelPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return findFlashcards(zettelPath, manifest)
+}
+
+// ApplyPlan carries out a plan. Cards are rendered with the given number of
+// workers; once ctx is cancelled rendering stops, the rendered cards are still
+// sent but no notes or media files are pruned. It returns the errors of all
+// failed actions.
+func ApplyPlan(ctx context.Context, k *kasten.Kasten, renders *rendercache.Cache, plan Plan, index Index, workers int) []error {
+	jobs, failed := planJobs(k, plan, index)
+
+	if err := ensureDeck(); err != nil {
+		return append(failed, err)
+	}
+	batch := NewBatch(connect)
+
+	var fixed []int
+	for _, action := range plan.Actions {
+		if action.Op != OpFix {
+			continue
+		}
+		if err := InsertFixme(k.Dir(action.Zettel), action.CardID, action.Fixme); err != nil {
+			failed = append(failed, fmt.Errorf("%s: %v", action.CardID, err))
+			continue
+		}
+		log.Printf("Stored the fixme of card %s in zettel %s", action.CardID, action.Zettel)
+		fixed = append(fixed, action.NoteID)
+	}
+
+	// Render the cards concurrently, the Anki requests are queued by this goroutine only
+	log.Printf("Rendering %d flashcards with %d workers", len(jobs), workers)
+	for result := range RenderAll(ctx, renders, jobs, workers) {
+		if result.Err != nil {
+			failed = append(failed, fmt.Errorf("%s: %v", result.Card.ID, result.Err))
+			continue
+		}
+		syncCard(batch, result)
+	}
+
+	if len(fixed) > 0 {
+		batch.Add("delete notes to fix", "deleteNotes", map[string]any{"notes": fixed})
+	}
+	batch.Flush()
+	failed = append(failed, batch.Errors()...)
+
+	// Remove the notes of cards that were deleted from the kasten,
+	// unless the run was interrupted
+	if ctx.Err() != nil {
+		return failed
+	}
+	for _, op := range []string{OpDelete, OpSuspend} {
+		var noteIDs []int
+		for _, action := range plan.Actions {
+			if action.Op == op {
+				noteIDs = append(noteIDs, action.NoteID)
+			}
+		}
+		if len(noteIDs) == 0 {
+			continue
+		}
+		notes, err := NotesInfo(connect, noteIDs)
+		if err == nil {
+			err = Prune(connect, notes, op == OpSuspend)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Errorf("pruning obsolete notes: %v", err))
+		}
+	}
+
+	// Updated and deleted notes leave their old SVGs behind
+	var deletedCards []string
+	for _, action := range plan.Actions {
+		if action.Op == OpFix || action.Op == OpDelete {
+			deletedCards = append(deletedCards, action.CardID)
+		}
+	}
+	deleted, err := CleanupMedia(connect, deletedCards)
+	if err != nil {
+		failed = append(failed, fmt.Errorf("cleaning up media: %v", err))
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d unused media files", deleted)
+	}
+	return failed
+}
+
+// Summary counts the actions of a plan by operation, e.g. "2 create, 1 update"
+func (plan Plan) Summary() string {
+	counts := map[string]int{}
+	for _, action := range plan.Actions {
+		counts[action.Op]++
+	}
+	summary := ""
+	for _, op := range []string{OpFix, OpCreate, OpUpdate, OpReplace, OpDelete, OpSuspend} {
+		if counts[op] == 0 {
+			continue
+		}
+		if summary != "" {
+			summary += ", "
+		}
+		summary += fmt.Sprintf("%d %s", counts[op], op)
+	}
+	if summary == "" {
+		return "nothing to do"
+	}
+	return summary
+}
+
+// WritePlanTable writes a plan as a table, one action per line
+func WritePlanTable(w io.Writer, plan Plan) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OP\tCARD\tZETTEL\tNOTE\tHASH")
+	for _, action := range plan.Actions {
+		note := "-"
+		if action.NoteID != 0 {
+			note = fmt.Sprint(action.NoteID)
+		}
+		zettel := action.Zettel
+		if zettel == "" {
+			zettel = "-"
+		}
+
+		hash := shortHash(action.NewHash)
+		switch action.Op {
+		case OpUpdate, OpReplace:
+			hash = shortHash(action.OldHash) + " -> " + hash
+		case OpDelete, OpSuspend:
+			hash = shortHash(action.OldHash)
+		case OpFix:
+			hash = fmt.Sprintf("%q", action.Fixme)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", action.Op, action.CardID, zettel, note, hash)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Plan for deck %s: %s\n", plan.Deck, plan.Summary())
+	return err
+}
+
+// shortHash abbreviates a hash for display
+func shortHash(hash string) string {
+	if hash == "" {
+		return "-"
+	}
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
+
+// WritePlan writes a plan as JSON
+func WritePlan(w io.Writer, plan Plan) error {
+	if plan.Actions == nil {
+		plan.Actions = []PlanAction{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(plan)
+}
+
+// ReadPlan reads a plan saved by WritePlan
+func ReadPlan(path string) (Plan, error) {
+	var plan Plan
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	if err := json.Unmarshal(content, &plan); err != nil {
+		return plan, fmt.Errorf("invalid plan %s: %v", path, err)
+	}
+	return plan, nil
+}
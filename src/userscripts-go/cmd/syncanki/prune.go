@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+// PresentIDs collects the ids of all cards defined in the kasten. Cards that
+// gencards did not render yet, that wait for a fix or that are malformed count
+// as present. It also returns the zettels with syntax errors, which may hide
+// cards from the parser.
+func PresentIDs(k *kasten.Kasten, c *cache.Cache, p *cache.Parser) (map[string]bool, []string, error) {
+	zettels, err := k.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := map[string]bool{}
+	var broken []string
+	for _, z := range zettels {
+		entry, err := c.Entry(p, z)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read zettel %s: %v", z, err)
+		}
+		for _, id := range entry.CardIDs() {
+			present[id] = true
+		}
+		if entry.SyntaxErrors > 0 {
+			broken = append(broken, z)
+		}
+	}
+	return present, broken, nil
+}
+
+// FindObsoleteNotes returns the notes of the xk note types in the deck whose
+// card no longer exists in the kasten, ordered by card id. Notes whose cards
+// are all suspended already are left out when suspending.
+func FindObsoleteNotes(api API, present map[string]bool, suspend bool) ([]NoteInfo, error) {
+	query := notesQuery()
+	if suspend {
+		query += " -is:suspended"
+	}
+
+	noteIDs, err := FindNotes(api, query)
+	if err != nil {
+		return nil, err
+	}
+	if len(noteIDs) == 0 {
+		return nil, nil
+	}
+
+	notes, err := NotesInfo(api, noteIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	var obsolete []NoteInfo
+	for _, note := range notes {
+		if !present[note.Field("id")] {
+			obsolete = append(obsolete, note)
+		}
+	}
+	sort.Slice(obsolete, func(i, j int) bool { return obsolete[i].Field("id") < obsolete[j].Field("id") })
+	return obsolete, nil
+}
+
+// ListObsoleteNotes writes what pruning would do to every note, one line per note
+func ListObsoleteNotes(w io.Writer, notes []NoteInfo, suspend bool) {
+	action := "delete"
+	if suspend {
+		action = "suspend"
+	}
+	for _, note := range notes {
+		fmt.Fprintf(w, "%s %s (note %d, %s)\n", action, note.Field("id"), note.NoteID, note.ModelName)
+	}
+}
+
+// Prune deletes the notes, or suspends their cards if suspend is set
+func Prune(api API, notes []NoteInfo, suspend bool) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	if suspend {
+		var cards []int
+		for _, note := range notes {
+			cards = append(cards, note.Cards...)
+		}
+		if err := SuspendCards(api, cards); err != nil {
+			return err
+		}
+		log.Printf("Suspended %d cards of %d obsolete notes", len(cards), len(notes))
+		return nil
+	}
+
+	noteIDs := make([]int, len(notes))
+	for i, note := range notes {
+		noteIDs[i] = note.NoteID
+	}
+	if err := DeleteNotes(api, noteIDs); err != nil {
+		return err
+	}
+	log.Printf("Deleted %d obsolete notes", len(notes))
+	return nil
+}
+
+// obsoleteNotes returns the notes of cards that were deleted from the kasten.
+// Nothing is pruned while a zettel has syntax errors.
+func obsoleteNotes(k *kasten.Kasten, c *cache.Cache, p *cache.Parser, suspend bool) ([]NoteInfo, error) {
+	present, broken, err := PresentIDs(k, c, p)
+	if err != nil {
+		return nil, err
+	}
+	if len(broken) > 0 {
+		log.Printf("Zettels %s have syntax errors, skipping pruning", strings.Join(broken, ", "))
+		return nil, nil
+	}
+
+	obsolete, err := FindObsoleteNotes(connect, present, suspend)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty kasten more likely means a broken setup than intent
+	if len(present) == 0 && len(obsolete) > 0 {
+		return nil, fmt.Errorf("no cards found in %s, refusing to prune %d notes", k.Root, len(obsolete))
+	}
+	return obsolete, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPresentIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{"flashcards and cloze cards", groupZettel, []string{"abl", "grp"}},
+		// a flashcard without its front and a cloze card without deletions
+		{"malformed cards", `\documentclass{article}
+\begin{document}
+\begin{flashcard}[grp]
+A set with an associative operation, a neutral element and inverses.
+\end{flashcard}
+\begin{clozecard}[abl]
+A group is abelian if $ab = ba$ for all its elements.
+\end{clozecard}
+\end{document}
+`, []string{"abl", "grp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := newTestKasten(t)
+			tk.writeZettel(t, "groups", tt.source)
+
+			present, broken, err := PresentIDs(tk.k, tk.c, tk.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(broken) != 0 {
+				t.Errorf("zettels with syntax errors: got %v", broken)
+			}
+			for _, id := range tt.want {
+				if !present[id] {
+					t.Errorf("card %s is missing from the present cards %v", id, present)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneKeepsCards(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		// the cloze note must not count as a note of a deleted flashcard
+		{"cloze cards", groupZettel},
+		// a flashcard without its front and a cloze card without deletions
+		{"malformed cards", `\documentclass{article}
+\begin{document}
+\begin{flashcard}[grp]
+A set with an associative operation, a neutral element and inverses.
+\end{flashcard}
+\begin{clozecard}[abl]
+A group is abelian if $ab = ba$ for all its elements.
+\end{clozecard}
+\end{document}
+`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tk := newTestKasten(t)
+			tk.writeZettel(t, "groups", groupZettel, groupCard, abelianCard)
+			tk.sync(t)
+			tk.writeZettel(t, "groups", tt.source)
+
+			for _, suspend := range []bool{false, true} {
+				obsolete, err := obsoleteNotes(tk.k, tk.c, tk.p, suspend)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(obsolete) != 0 {
+					t.Errorf("notes of existing cards are obsolete (suspend %v): %+v", suspend, obsolete)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneSkipsZettelsWithSyntaxErrors(t *testing.T) {
+	tk := newTestKasten(t)
+	tk.writeZettel(t, "groups", groupZettel, groupCard, abelianCard)
+	tk.sync(t)
+
+	// the unclosed group hides the cards from the parser
+	tk.writeZettel(t, "groups", `\documentclass{article}
+\begin{document}
+\textbf{
+\begin{flashcard}[grp]{What is a group?}
+A set with an associative operation, a neutral element and inverses.
+\end{flashcard}
+\end{document}
+`)
+
+	_, broken, err := PresentIDs(tk.k, tk.c, tk.p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(broken, []string{"groups"}) {
+		t.Fatalf("zettels with syntax errors: got %v", broken)
+	}
+	obsolete, err := obsoleteNotes(tk.k, tk.c, tk.p, false)
+	if err != nil || len(obsolete) != 0 {
+		t.Errorf("pruning despite the syntax errors: %+v, %v", obsolete, err)
+	}
+
+	// once the zettel is fixed the deleted cloze card is pruned
+	tk.writeZettel(t, "groups", `\documentclass{article}
+\begin{document}
+\begin{flashcard}[grp]{What is a group?}
+A set with an associative operation, a neutral element and inverses.
+\end{flashcard}
+\end{document}
+`)
+	obsolete, err = obsoleteNotes(tk.k, tk.c, tk.p, false)
+	if err != nil || len(obsolete) != 1 || obsolete[0].Field("id") != "abl" {
+		t.Errorf("pruning the deleted cloze card: %+v, %v", obsolete, err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"sync"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/rendercache"
+)
+
+// Rendered holds the base64 encoded SVGs of a card, one front and back per deletion
+type Rendered struct {
+	Fronts []string
+	Backs  []string
+}
+
+// RenderJob is a flashcard that has to be rendered and synced
+type RenderJob struct {
+	Card   Flashcard
+	Note   NoteInfo // the note of the card in Anki, only set if Exists
+	Exists bool
+}
+
+// RenderResult is a rendered job, or the reason it could not be rendered
+type RenderResult struct {
+	RenderJob
+	Rendered
+	Err error
+}
+
+// RenderCard compiles all sides of a flashcard, unless the render cache
+// already holds them. renders may be nil.
+func RenderCard(ctx context.Context, renders *rendercache.Cache, card Flashcard) (Rendered, error) {
+	sides := card.Deletions
+	if len(sides) == 0 {
+		sides = []flashcard.CardFiles{{Front: card.Front, Back: card.Back}}
+	}
+	if len(sides) > maxDeletions {
+		return Rendered{}, fmt.Errorf("cloze card %s has more than %d deletions", card.ID, maxDeletions)
+	}
+
+	// HTML cards need no LaTeX
+	if card.HTMLFronts != nil {
+		return Rendered{}, nil
+	}
+
+	if renders != nil {
+		if cached, ok := renders.Get(card.Hash); ok && len(cached.Fronts) == len(sides) {
+			log.Printf("Using cached rendering of flashcard %s", card.ID)
+			return fromCache(cached), nil
+		}
+	}
+
+	var rendered Rendered
+	for _, side := range sides {
+		frontSVG, err := Tex2Base64(ctx, side.Front)
+		if err != nil {
+			return Rendered{}, err
+		}
+		backSVG, err := Tex2Base64(ctx, side.Back)
+		if err != nil {
+			return Rendered{}, err
+		}
+		rendered.Fronts = append(rendered.Fronts, frontSVG)
+		rendered.Backs = append(rendered.Backs, backSVG)
+	}
+
+	if renders != nil {
+		cached, err := toCache(rendered)
+		if err == nil {
+			err = renders.Put(card.Hash, cached)
+		}
+		if err != nil {
+			log.Printf("Failed to cache rendering of flashcard %s: %v", card.ID, err)
+		}
+	}
+	return rendered, nil
+}
+
+// toCache decodes base64 encoded SVGs for the render cache
+func toCache(rendered Rendered) (rendercache.Rendered, error) {
+	var cached rendercache.Rendered
+	for i := range rendered.Fronts {
+		front, err := base64.StdEncoding.DecodeString(rendered.Fronts[i])
+		if err != nil {
+			return cached, err
+		}
+		back, err := base64.StdEncoding.DecodeString(rendered.Backs[i])
+		if err != nil {
+			return cached, err
+		}
+		cached.Fronts = append(cached.Fronts, front)
+		cached.Backs = append(cached.Backs, back)
+	}
+	return cached, nil
+}
+
+// fromCache encodes cached SVGs the way Tex2Base64 returns them
+func fromCache(cached rendercache.Rendered) Rendered {
+	var rendered Rendered
+	for i := range cached.Fronts {
+		rendered.Fronts = append(rendered.Fronts, base64.StdEncoding.EncodeToString(cached.Fronts[i]))
+		rendered.Backs = append(rendered.Backs, base64.StdEncoding.EncodeToString(cached.Backs[i]))
+	}
+	return rendered
+}
+
+// RenderAll renders the jobs with at most workers cards at a time and sends
+// the results in the order the jobs finish. The channel is closed after the
+// last result, so it must be drained. Once ctx is cancelled running LaTeX
+// processes are killed and the remaining jobs fail with the context's error.
+func RenderAll(ctx context.Context, renders *rendercache.Cache, jobs []RenderJob, workers int) <-chan RenderResult {
+	queue := make(chan RenderJob)
+	results := make(chan RenderResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				result := RenderResult{RenderJob: job}
+				if result.Err = ctx.Err(); result.Err == nil {
+					result.Rendered, result.Err = RenderCard(ctx, renders, job.Card)
+				}
+				results <- result
+			}
+		}()
+	}
+
+	go func() {
+		for _, job := range jobs {
+			queue <- job
+		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+// StatsFilename is the name of the review statistics written into every zettel
+// directory with cards in Anki, and of the report of the whole kasten
+const StatsFilename = "card-stats.json"
+
+// CardStats is how a card of the kasten fares in Anki
+type CardStats struct {
+	ID        string `json:"id"`
+	Note      int    `json:"note"`
+	Cards     int    `json:"cards"` // Anki cards of the note, one per deletion of a cloze card
+	Reviews   int    `json:"reviews"`
+	Again     int    `json:"again"` // reviews answered with again
+	Lapses    int    `json:"lapses"`
+	Ease      int    `json:"ease"`     // lowest ease of the Anki cards in percent, 0 if none was reviewed
+	Interval  int    `json:"interval"` // shortest interval of the Anki cards in days
+	Leech     bool   `json:"leech"`
+	Suspended bool   `json:"suspended"` // all Anki cards are suspended
+}
+
+// ZettelStats sums up the cards of a zettel
+type ZettelStats struct {
+	Zettel   string      `json:"zettel"`
+	Reviews  int         `json:"reviews"`
+	Again    int         `json:"again"`
+	Lapses   int         `json:"lapses"`
+	Leeches  int         `json:"leeches"`
+	Ease     int         `json:"ease"`     // lowest ease of its cards in percent, 0 if none was reviewed
+	Interval int         `json:"interval"` // shortest interval of its cards in days
+	Cards    []CardStats `json:"cards"`
+}
+
+// AgainRate is the share of reviews answered with again
+func (s ZettelStats) AgainRate() float64 {
+	if s.Reviews == 0 {
+		return 0
+	}
+	return float64(s.Again) / float64(s.Reviews)
+}
+
+// StatsReport lists the zettels with cards in Anki, the hardest first
+type StatsReport struct {
+	Deck    string        `json:"deck"`
+	Zettels []ZettelStats `json:"zettels"`
+}
+
+// CollectStats fetches the scheduling state and review logs of the notes of
+// the xk note types in the deck and sums them up per card and per zettel.
+// Notes whose card no longer exists in the kasten are left out.
+func CollectStats(api API, k *kasten.Kasten) (StatsReport, error) {
+	report := StatsReport{Deck: deck}
+
+	// the manifests tell which zettel defines a card
+	zettels, err := k.List()
+	if err != nil {
+		return report, err
+	}
+	owners := map[string]string{}
+	order := map[string][]string{}
+	for _, z := range zettels {
+		manifest, err := flashcard.ReadManifest(k.Dir(z))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, card := range manifest.Cards {
+			owners[card.ID] = z
+			order[z] = append(order[z], card.ID)
+		}
+	}
+
+	noteIDs, err := FindNotes(api, notesQuery())
+	if err != nil {
+		return report, err
+	}
+	if len(noteIDs) == 0 {
+		return report, nil
+	}
+	notes, err := NotesInfo(api, noteIDs)
+	if err != nil {
+		return report, err
+	}
+
+	var cardIDs []int
+	for _, note := range notes {
+		cardIDs = append(cardIDs, note.Cards...)
+	}
+	infos, err := CardsInfo(api, cardIDs)
+	if err != nil {
+		return report, err
+	}
+	reviews, err := GetReviewsOfCards(api, cardIDs)
+	if err != nil {
+		return report, err
+	}
+	scheduling := map[int]CardInfo{}
+	for _, info := range infos {
+		scheduling[info.CardID] = info
+	}
+
+	stats := map[string]CardStats{}
+	for _, note := range notes {
+		id := note.Field("id")
+		if _, ok := owners[id]; !ok {
+			log.Printf("Card %s of note %d is not in the kasten, skipping its statistics", id, note.NoteID)
+			continue
+		}
+		stats[id] = cardStats(note, scheduling, reviews)
+	}
+
+	for _, z := range zettels {
+		zs := ZettelStats{Zettel: z}
+		for _, id := range order[z] {
+			card, ok := stats[id]
+			if !ok {
+				continue
+			}
+			zs.Cards = append(zs.Cards, card)
+			zs.Reviews += card.Reviews
+			zs.Again += card.Again
+			zs.Lapses += card.Lapses
+			if card.Leech {
+				zs.Leeches++
+			}
+			if card.Ease > 0 && (zs.Ease == 0 || card.Ease < zs.Ease) {
+				zs.Ease = card.Ease
+			}
+			if len(zs.Cards) == 1 || card.Interval < zs.Interval {
+				zs.Interval = card.Interval
+			}
+		}
+		if len(zs.Cards) > 0 {
+			report.Zettels = append(report.Zettels, zs)
+		}
+	}
+
+	// zettels whose cards are leeches or lapse often need rework first
+	sort.SliceStable(report.Zettels, func(i, j int) bool {
+		a, b := report.Zettels[i], report.Zettels[j]
+		if a.Leeches != b.Leeches {
+			return a.Leeches > b.Leeches
+		}
+		if a.Lapses != b.Lapses {
+			return a.Lapses > b.Lapses
+		}
+		return a.AgainRate() > b.AgainRate()
+	})
+	return report, nil
+}
+
+// cardStats sums up the Anki cards of a note
+func cardStats(note NoteInfo, scheduling map[int]CardInfo, reviews map[int][]Review) CardStats {
+	stats := CardStats{ID: note.Field("id"), Note: note.NoteID, Cards: len(note.Cards), Suspended: len(note.Cards) > 0}
+	for _, tag := range note.Tags {
+		if strings.EqualFold(tag, "leech") {
+			stats.Leech = true
+		}
+	}
+
+	for i, id := range note.Cards {
+		info := scheduling[id]
+		stats.Lapses += info.Lapses
+		if info.Queue != -1 {
+			stats.Suspended = false
+		}
+		// learning cards have their interval in seconds
+		interval := max(0, info.Interval)
+		if i == 0 || interval < stats.Interval {
+			stats.Interval = interval
+		}
+		if ease := info.Factor / 10; ease > 0 && (stats.Ease == 0 || ease < stats.Ease) {
+			stats.Ease = ease
+		}
+
+		for _, review := range reviews[id] {
+			// manual rescheduling is no review
+			if review.Ease == 0 {
+				continue
+			}
+			stats.Reviews++
+			if review.Ease == 1 {
+				stats.Again++
+			}
+		}
+	}
+	return stats
+}
+
+// WriteZettelStats writes the statistics of every zettel of the report into
+// its directory and removes those of zettels without cards in Anki
+func WriteZettelStats(k *kasten.Kasten, report StatsReport) error {
+	zettels, err := k.List()
+	if err != nil {
+		return err
+	}
+	reported := map[string]ZettelStats{}
+	for _, zs := range report.Zettels {
+		reported[zs.Zettel] = zs
+	}
+
+	for _, z := range zettels {
+		path := k.File(z, StatsFilename)
+		zs, ok := reported[z]
+		if !ok {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		content, err := json.MarshalIndent(zs, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write statistics of zettel %s: %v", z, err)
+		}
+	}
+	return nil
+}
+
+// SaveStats writes the report of the whole kasten to ZETTEL_DATA/.xk and returns its path
+func SaveStats(k *kasten.Kasten, report StatsReport) (string, error) {
+	dir, err := k.StateDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, StatsFilename)
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	err = WriteStats(file, report)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return path, err
+}
+
+// WriteStatsTable writes the report as a table, one line per zettel
+func WriteStatsTable(w io.Writer, report StatsReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZETTEL\tCARDS\tREVIEWS\tAGAIN\tLAPSES\tLEECHES\tEASE\tINTERVAL")
+	cards, leeches := 0, 0
+	for _, zs := range report.Zettels {
+		ease := "-"
+		if zs.Ease > 0 {
+			ease = fmt.Sprintf("%d%%", zs.Ease)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f%%\t%d\t%d\t%s\t%dd\n",
+			zs.Zettel, len(zs.Cards), zs.Reviews, 100*zs.AgainRate(), zs.Lapses, zs.Leeches, ease, zs.Interval)
+		cards += len(zs.Cards)
+		leeches += zs.Leeches
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "Deck %s: %d cards in %d zettels, %d leeches\n", report.Deck, cards, len(report.Zettels), leeches)
+	return err
+}
+
+// WriteStats writes the report as JSON
+func WriteStats(w io.Writer, report StatsReport) error {
+	if report.Zettels == nil {
+		report.Zettels = []ZettelStats{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"reflect"
+	"testing"
+	"xk/src/userscripts-go/pkg/cache"
+	"xk/src/userscripts-go/pkg/fakeanki"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/rendercache"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// testCard is a card as gencards would write it. The sides of SVG cards are
+// put into the render cache, so that syncing needs no LaTeX installation.
+type testCard struct {
+	ID     string
+	Kind   string
+	Render string // flashcard.RenderHTML for an HTML card, else an SVG card
+	Fronts []string
+	Backs  []string
+}
+
+// testKasten is an empty kasten synced to an in-memory Anki
+type testKasten struct {
+	k       *kasten.Kasten
+	c       *cache.Cache
+	p       *cache.Parser
+	anki    *fakeanki.Anki
+	renders *rendercache.Cache
+}
+
+// newTestKasten creates an empty kasten and points syncanki at a fake Anki
+func newTestKasten(t *testing.T) *testKasten {
+	t.Helper()
+	if treesitter.Language() == nil {
+		t.Skip("the LaTeX grammar is not built")
+	}
+
+	t.Setenv("ZETTEL_DATA", t.TempDir())
+	t.Setenv("TS_QUERY_REF", "(citation (curly_group_text_list) @reference)")
+	k, err := kasten.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := cache.Open(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := cache.NewParser(sitter.NewLanguage(treesitter.Language()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	renders, err := rendercache.Open(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anki := fakeanki.New()
+	t.Cleanup(useAnki(anki, "xk", "xkCard", "xkCloze"))
+
+	return &testKasten{k: k, c: c, p: p, anki: anki, renders: renders}
+}
+
+// writeZettel writes the source of a zettel together with the manifest and
+// card files of its cards, and puts their renderings into the render cache
+func (tk *testKasten) writeZettel(t *testing.T, zettel, source string, cards ...testCard) {
+	t.Helper()
+	dir := tk.k.Dir(zettel)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tk.k.File(zettel, tk.k.ZettelFilename), []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var manifest flashcard.Manifest
+	for _, card := range cards {
+		files := flashcard.Files(card.Kind, card.ID, len(card.Fronts))
+		var fronts, backs [][]byte
+		var rendered rendercache.Rendered
+		for i := range files {
+			front, back := []byte("\\begin{document}"+card.Fronts[i]), []byte("\\begin{document}"+card.Backs[i])
+			fronts, backs = append(fronts, front), append(backs, back)
+			if err := os.WriteFile(tk.k.File(zettel, files[i].Front), front, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(tk.k.File(zettel, files[i].Back), back, 0644); err != nil {
+				t.Fatal(err)
+			}
+			rendered.Fronts = append(rendered.Fronts, []byte(svg(card.Fronts[i])))
+			rendered.Backs = append(rendered.Backs, []byte(svg(card.Backs[i])))
+		}
+
+		hash := flashcard.HashSides(fronts, backs)
+		manifestCard := flashcard.ManifestCard{
+			ID:     card.ID,
+			Kind:   card.Kind,
+			Hash:   hash,
+			Files:  files,
+			Render: card.Render,
+		}
+		if card.Render == flashcard.RenderHTML {
+			manifestCard.HTML = flashcard.HTMLFiles(card.Kind, card.ID, len(card.Fronts))
+			for i, html := range manifestCard.HTML {
+				if err := os.WriteFile(tk.k.File(zettel, html.Front), []byte(card.Fronts[i]), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(tk.k.File(zettel, html.Back), []byte(card.Backs[i]), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		} else if err := tk.renders.Put(hash, rendered); err != nil {
+			t.Fatal(err)
+		}
+		manifest.Cards = append(manifest.Cards, manifestCard)
+	}
+	if _, err := flashcard.WriteManifest(dir, manifest); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// svg is the rendering of a side of a test card
+func svg(text string) string {
+	return "<svg><text>" + text + "</text></svg>"
+}
+
+// sync plans and applies a sync like a plain syncanki run and returns the
+// operations of the plan, e.g. "create abc"
+func (tk *testKasten) sync(t *testing.T) []string {
+	t.Helper()
+	index, err := LoadIndex(connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := BuildPlan(tk.k, tk.c, tk.p, index, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := ApplyPlan(context.Background(), tk.k, tk.renders, plan, index, 2); len(failed) > 0 {
+		t.Fatalf("sync failed: %v", failed)
+	}
+
+	ops := []string{}
+	for _, action := range plan.Actions {
+		ops = append(ops, action.Op+" "+action.CardID)
+	}
+	return ops
+}
+
+// note returns the note of a card in the fake Anki
+func (tk *testKasten) note(cardID string) (fakeanki.Note, bool) {
+	for _, note := range tk.anki.Notes() {
+		if note.Fields["id"] == cardID {
+			return note, true
+		}
+	}
+	return fakeanki.Note{}, false
+}
+
+// media returns the content of the media file a field of a note refers to
+func (tk *testKasten) media(note fakeanki.Note, field string) string {
+	m := srcPattern.FindStringSubmatch(note.Fields[field])
+	if m == nil {
+		return ""
+	}
+	data, _ := tk.anki.Media(m[1])
+	return string(data)
+}
+
+const groupZettel = `\documentclass{article}
+\begin{document}
+\begin{flashcard}[grp]{What is a group?}
+A set with an associative operation, a neutral element and inverses.
+\end{flashcard}
+\begin{clozecard}[abl]
+A group is \cloze{abelian} if \cloze{$ab = ba$} for all its elements.
+\end{clozecard}
+\end{document}
+`
+
+var (
+	groupCard = testCard{ID: "grp", Kind: flashcard.KindBasic,
+		Fronts: []string{"What is a group?"}, Backs: []string{"A set with an associative operation"}}
+	abelianCard = testCard{ID: "abl", Kind: flashcard.KindCloze,
+		Fronts: []string{"A group is [...] if ab = ba", "A group is abelian if [...]"},
+		Backs:  []string{"A group is abelian if ab = ba", "A group is abelian if ab = ba"}}
+)
+
+func TestSyncCycle(t *testing.T) {
+	tk := newTestKasten(t)
+
+	// create
+	tk.writeZettel(t, "groups", groupZettel, groupCard, abelianCard)
+	if ops := tk.sync(t); !reflect.DeepEqual(ops, []string{"create grp", "create abl"}) {
+		t.Fatalf("first sync: got %v", ops)
+	}
+	note, ok := tk.note("grp")
+	if !ok || note.Model != "xkCard" {
+		t.Fatalf("card grp was not added as basic note: %+v", note)
+	}
+	if got := tk.media(note, "back"); got != svg(groupCard.Backs[0]) {
+		t.Fatalf("back of grp: got %q", got)
+	}
+	cloze, ok := tk.note("abl")
+	if !ok || cloze.Model != "xkCloze" {
+		t.Fatalf("cloze card abl was not added as cloze note: %+v", cloze)
+	}
+	if cards := tk.anki.Cards(cloze.ID); len(cards) != 2 {
+		t.Fatalf("cloze note has %d cards, want one per deletion", len(cards))
+	}
+
+	// nothing changed, in particular the cloze note must not be pruned
+	if ops := tk.sync(t); len(ops) != 0 {
+		t.Fatalf("sync without changes: got %v", ops)
+	}
+	if notes := tk.anki.Notes(); len(notes) != 2 {
+		t.Fatalf("sync without changes: got notes %+v", notes)
+	}
+
+	// update
+	changed := groupCard
+	changed.Backs = []string{"A monoid with inverses"}
+	tk.writeZettel(t, "groups", groupZettel, changed, abelianCard)
+	if ops := tk.sync(t); !reflect.DeepEqual(ops, []string{"update grp"}) {
+		t.Fatalf("sync after update: got %v", ops)
+	}
+	updated, _ := tk.note("grp")
+	if updated.ID != note.ID || updated.Fields["hash"] == note.Fields["hash"] {
+		t.Fatalf("note of grp was not updated: %+v", updated)
+	}
+	if got := tk.media(updated, "back"); got != svg("A monoid with inverses") {
+		t.Fatalf("back of grp after update: got %q", got)
+	}
+	old := srcPattern.FindStringSubmatch(note.Fields["back"])[1]
+	if _, ok := tk.anki.Media(old); ok {
+		t.Fatalf("the previous back of grp %s was not deleted", old)
+	}
+
+	// fixme
+	if err := tk.anki.SetField(note.ID, "fixme", "mention closure"); err != nil {
+		t.Fatal(err)
+	}
+	if ops := tk.sync(t); !reflect.DeepEqual(ops, []string{"fix grp"}) {
+		t.Fatalf("sync after fixme: got %v", ops)
+	}
+	fix, err := os.ReadFile(tk.k.File("groups", "fix_grp"))
+	if err != nil || string(fix) != "mention closure" {
+		t.Fatalf("fixme was not stored next to the card: %q, %v", fix, err)
+	}
+	if _, ok := tk.note("grp"); ok {
+		t.Fatal("note of the fixed card grp still exists")
+	}
+	if _, ok := tk.note("abl"); !ok {
+		t.Fatal("note of abl was removed with the fixed card")
+	}
+
+	// prune, the media files abl had before they were versioned go too
+	legacy := map[string]any{"filename": "abl_1_front.svg", "data": base64.StdEncoding.EncodeToString([]byte(svg("abl")))}
+	var stored GenericResponse[string]
+	if err := tk.anki.Request("storeMediaFile", legacy, &stored); err != nil {
+		t.Fatal(err)
+	}
+	source := `\documentclass{article}
+\begin{document}
+\begin{flashcard}[grp]{What is a group?}
+A monoid with inverses.
+\end{flashcard}
+\end{document}
+`
+	tk.writeZettel(t, "groups", source, changed)
+	if ops := tk.sync(t); !reflect.DeepEqual(ops, []string{"delete abl"}) {
+		t.Fatalf("sync after removing abl: got %v", ops)
+	}
+	if notes := tk.anki.Notes(); len(notes) != 0 {
+		t.Fatalf("notes left after pruning: %+v", notes)
+	}
+	if names := tk.anki.MediaNames(); len(names) != 0 {
+		t.Fatalf("media files left after pruning: %v", names)
+	}
+}
+
+func TestSyncIdenticalFronts(t *testing.T) {
+	tk := newTestKasten(t)
+
+	// the fronts of HTML cards are the first fields of their notes, which
+	// Anki checks for duplicates
+
+	source := `\documentclass{article}
+\begin{document}
+\begin{flashcard}[ker]{Definition?}
+The kernel of a homomorphism.
+\end{flashcard}
+\begin{flashcard}[img]{Definition?}
+The image of a homomorphism.
+\end{flashcard}
+\end{document}
+`
+	tk.writeZettel(t, "homomorphisms", source,
+		testCard{ID: "ker", Kind: flashcard.KindBasic, Render: flashcard.RenderHTML, Fronts: []string{"Definition?"}, Backs: []string{"The kernel"}},
+		testCard{ID: "img", Kind: flashcard.KindBasic, Render: flashcard.RenderHTML, Fronts: []string{"Definition?"}, Backs: []string{"The image"}})
+	if ops := tk.sync(t); !reflect.DeepEqual(ops, []string{"create ker", "create img"}) {
+		t.Fatalf("first sync: got %v", ops)
+	}
+	for _, id := range []string{"ker", "img"} {
+		if note, ok := tk.note(id); !ok || note.Fields["front"] != "Definition?" {
+			t.Errorf("card %s with the same front as another one was not added: %+v", id, note)
+		}
+	}
+}
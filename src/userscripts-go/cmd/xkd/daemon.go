@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os/exec"
+	"sort"
+	"time"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+// Daemon regenerates the derived files of zettels once their changes settle.
+type Daemon struct {
+	kasten   *kasten.Kasten
+	debounce time.Duration // quiet period after the last change before anything runs
+	pdf      bool          // also build zettel.pdf with latexmk
+}
+
+// Run processes the zettels reported on changes until ctx is cancelled or changes is closed.
+// Changes arriving within the debounce period are collected and processed together.
+func (d *Daemon) Run(ctx context.Context, changes <-chan string) {
+	pending := map[string]time.Time{}
+	timer := time.NewTimer(d.debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case zettel, ok := <-changes:
+			if !ok {
+				return
+			}
+			pending[zettel] = time.Now().Add(d.debounce)
+			timer.Reset(d.debounce)
+
+		case <-timer.C:
+			now := time.Now()
+			var due []string
+			var next time.Time
+			for zettel, deadline := range pending {
+				if !deadline.After(now) {
+					due = append(due, zettel)
+				} else if next.IsZero() || deadline.Before(next) {
+					next = deadline
+				}
+			}
+			sort.Strings(due)
+
+			for _, zettel := range due {
+				delete(pending, zettel)
+				if ctx.Err() != nil {
+					return
+				}
+				d.process(ctx, zettel)
+			}
+			if !next.IsZero() {
+				timer.Reset(time.Until(next))
+			}
+		}
+	}
+}
+
+// process reruns reference extraction and flashcard generation for one zettel
+func (d *Daemon) process(ctx context.Context, zettel string) {
+	if !d.kasten.Exists(zettel) {
+		// the zettel was removed before the debounce expired
+		return
+	}
+
+	log.Printf("Processing %s", zettel)
+	d.run(ctx, "", "genrefs", "-z", zettel)
+	d.run(ctx, "", "gencards", "-z", zettel)
+	if d.pdf {
+		d.run(ctx, d.kasten.Dir(zettel), "latexmk", "-pdf", "-silent", "-interaction=nonstopmode", d.kasten.ZettelFilename)
+	}
+}
+
+// run executes a command and writes its output to the daemon log
+func (d *Daemon) run(ctx context.Context, dir, name string, args ...string) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = log.Writer()
+	cmd.Stderr = log.Writer()
+
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		log.Printf("Error running %s %v: %v", name, args, err)
+		return
+	}
+	log.Printf("Ran %s %v in %v", name, args, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"xk/src/userscripts-go/pkg/kasten"
+	"xk/src/userscripts-go/pkg/logging"
+)
+
+// xkd watches the kasten and reruns genrefs and gencards for every saved zettel.
+// It is meant to be started through xk (so that the configuration is exported),
+// e.g. from a systemd user service running `xk script xkd`.
+func main() {
+	debounce := flag.Duration("debounce", 500*time.Millisecond, "Time to wait after the last change of a Zettel before processing it")
+	pdf := flag.Bool("pdf", false, "Also build the PDF of a changed Zettel with latexmk")
+	logFile := flag.String("log", "", "Append the log to this file instead of writing it to stderr")
+	flag.Parse()
+
+	if *logFile != "" {
+		file, err := logging.SetLogOutput(*logFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+	}
+
+	k, err := kasten.FromEnv()
+	if err != nil {
+		log.Fatalf("Error opening kasten: %v", err)
+	}
+
+	watcher, err := NewWatcher(k.Root, k.ZettelFilename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer watcher.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	changes := make(chan string)
+	go func() {
+		if err := watcher.Run(changes); err != nil {
+			log.Print(err)
+			stop()
+		}
+	}()
+
+	log.Printf("Watching %s", k.Root)
+	daemon := Daemon{kasten: k, debounce: *debounce, pdf: *pdf}
+	daemon.Run(ctx, changes)
+	log.Printf("Shutting down")
+}
@@ -0,0 +1,168 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// events in ZETTEL_DATA: zettel directories appearing or disappearing
+	rootMask = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_ONLYDIR
+	// events in a zettel directory: files written in place or saved atomically by renaming
+	zettelMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+)
+
+// Watcher reports the names of zettels whose zettel file changed.
+// ZETTEL_DATA itself is watched to pick up new and renamed zettels.
+type Watcher struct {
+	fd       int      // used for adding watches; calling file.Fd() would make reads blocking
+	file     *os.File // reads the events
+	root     string
+	filename string
+	zettels  map[int32]string // watch descriptor -> zettel name
+	watches  map[string]int32 // zettel name -> watch descriptor
+	rootWD   int32
+}
+
+// NewWatcher starts watching ZETTEL_DATA and every zettel directory in it.
+func NewWatcher(root, filename string) (*Watcher, error) {
+	// a non-blocking descriptor lets Close interrupt a pending Read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %v", err)
+	}
+
+	w := &Watcher{
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		root:     root,
+		filename: filename,
+		zettels:  map[int32]string{},
+		watches:  map[string]int32{},
+	}
+
+	wd, err := syscall.InotifyAddWatch(fd, root, rootMask)
+	if err != nil {
+		w.file.Close()
+		return nil, fmt.Errorf("failed to watch %s: %v", root, err)
+	}
+	w.rootWD = int32(wd)
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		w.file.Close()
+		return nil, fmt.Errorf("failed to list zettels: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+			if err := w.add(entry.Name()); err != nil {
+				w.file.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// Close stops the watcher, Run returns afterwards.
+func (w *Watcher) Close() error {
+	return w.file.Close()
+}
+
+// add watches a zettel directory
+func (w *Watcher) add(zettel string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, filepath.Join(w.root, zettel), zettelMask)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %v", zettel, err)
+	}
+	w.zettels[int32(wd)] = zettel
+	w.watches[zettel] = int32(wd)
+	return nil
+}
+
+// remove stops watching a zettel directory that was moved away
+func (w *Watcher) remove(zettel string) {
+	wd, ok := w.watches[zettel]
+	if !ok {
+		return
+	}
+	// the kernel answers with IN_IGNORED, which drops the descriptor from the maps
+	syscall.InotifyRmWatch(w.fd, uint32(wd))
+	delete(w.watches, zettel)
+}
+
+// Run reads events and sends the names of changed zettels until the watcher is closed.
+func (w *Watcher) Run(changes chan<- string) error {
+	defer close(changes)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read inotify events: %v", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+
+			if zettel := w.handle(event.Wd, event.Mask, name); zettel != "" {
+				changes <- zettel
+			}
+		}
+	}
+}
+
+// handle updates the watches and returns the zettel whose file changed, if any
+func (w *Watcher) handle(wd int32, mask uint32, name string) string {
+	switch {
+	case mask&syscall.IN_Q_OVERFLOW != 0:
+		log.Printf("Inotify queue overflowed, some changes were missed")
+
+	case mask&syscall.IN_IGNORED != 0:
+		// the zettel directory was deleted or is no longer watched
+		if zettel, ok := w.zettels[wd]; ok {
+			delete(w.zettels, wd)
+			if w.watches[zettel] == wd {
+				delete(w.watches, zettel)
+			}
+		}
+
+	case wd == w.rootWD:
+		if mask&syscall.IN_ISDIR == 0 || strings.HasPrefix(name, ".") {
+			return ""
+		}
+		if mask&syscall.IN_MOVED_FROM != 0 {
+			w.remove(name)
+			return ""
+		}
+		if err := w.add(name); err != nil {
+			log.Print(err)
+			return ""
+		}
+		// the zettel file may have been written before the watch was in place
+		if _, err := os.Stat(filepath.Join(w.root, name, w.filename)); err == nil {
+			return name
+		}
+
+	case name == w.filename:
+		return w.zettels[wd]
+	}
+
+	return ""
+}
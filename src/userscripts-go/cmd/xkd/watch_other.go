@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Watcher reports the names of zettels whose zettel file changed.
+// Watching relies on inotify, so it is only available on Linux.
+type Watcher struct{}
+
+// NewWatcher fails, there is no inotify on this platform.
+func NewWatcher(root, filename string) (*Watcher, error) {
+	return nil, errors.New("watching the kasten needs inotify, which is unsupported on this platform")
+}
+
+// Close stops the watcher, Run returns afterwards.
+func (w *Watcher) Close() error {
+	return nil
+}
+
+// Run never reports changes on this platform.
+func (w *Watcher) Run(changes chan<- string) error {
+	return errors.New("inotify unsupported")
+}
@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+// cacheVersion is bumped whenever the extraction or the file format changes
+const cacheVersion = 4
+
+// Stamp identifies the state of a file. Size and modification time are
+// checked first, the content hash decides if they differ.
+type Stamp struct {
+	ModTime int64 // unix nanoseconds
+	Size    int64
+	Hash    string // sha256 of the content
+}
+
+// Cache stores what was extracted from every zettel file, keyed by the path
+// of the file relative to ZETTEL_DATA. It is safe for concurrent use.
+// Concurrent processes simply overwrite each other's cache file; entries lost
+// that way are reparsed on the next run.
+type Cache struct {
+	path    string
+	kasten  *kasten.Kasten
+	mu      sync.Mutex
+	entries map[string]*Entry
+	dirty   bool
+}
+
+// file is the on-disk format of the cache
+type file struct {
+	Version int
+	Entries map[string]*Entry
+}
+
+// Open loads the cache of a kasten from ZETTEL_DATA/.xk/cache.
+// A missing, unreadable or outdated cache file yields an empty cache.
+func Open(k *kasten.Kasten) (*Cache, error) {
+	dir, err := k.StateDir("cache")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		path:    filepath.Join(dir, "zettels.gob"),
+		kasten:  k,
+		entries: map[string]*Entry{},
+	}
+
+	f, err := os.Open(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var content file
+	if err := gob.NewDecoder(f).Decode(&content); err != nil || content.Version != cacheVersion {
+		c.dirty = true
+		return c, nil
+	}
+	if content.Entries != nil {
+		c.entries = content.Entries
+	}
+	return c, nil
+}
+
+// Save writes the cache atomically if any entry changed.
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".zettels-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(file{cacheVersion, c.entries}); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+
+	c.dirty = false
+	return nil
+}
+
+// key returns the cache key of a zettel, the path of its file relative to ZETTEL_DATA
+func (c *Cache) key(zettel string) string {
+	return filepath.Join(kasten.Normalize(zettel), c.kasten.ZettelFilename)
+}
+
+// Entry returns the extracted data of a zettel, reparsing it with p only if
+// its file changed. The returned entry must not be modified.
+func (c *Cache) Entry(p *Parser, zettel string) (*Entry, error) {
+	zettel = kasten.Normalize(zettel)
+	key := c.key(zettel)
+
+	c.mu.Lock()
+	cached := c.entries[key]
+	c.mu.Unlock()
+
+	path := c.kasten.File(zettel, c.kasten.ZettelFilename)
+	sourceStamp, source, sourceChanged, err := refresh(path, stampOf(cached, false))
+	if err != nil {
+		return nil, err
+	}
+	tagStamp, tags, tagsChanged, err := refresh(c.kasten.File(zettel, c.kasten.TagFilename), stampOf(cached, true))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// entries extracted with another reference configuration are reparsed
+	reusable := cached != nil && cached.Config == p.config
+	if reusable && !sourceChanged && !tagsChanged {
+		return cached, nil
+	}
+
+	// entries are shared between goroutines, so a changed entry is a new copy
+	var entry Entry
+	if reusable && cached.Source.Hash == sourceStamp.Hash {
+		// only the modification time or the tags changed
+		entry = *cached
+	} else {
+		if source == nil {
+			// the stamp matched but there is no usable entry
+			if source, err = os.ReadFile(path); err != nil {
+				return nil, err
+			}
+		}
+		entry = p.Parse(zettel, source)
+		if cached != nil {
+			entry.Tags = cached.Tags
+		}
+	}
+	entry.Path = key
+	entry.Source = sourceStamp
+	entry.TagFile = tagStamp
+	if tagsChanged {
+		entry.Tags = kasten.ParseLines(tags)
+	}
+
+	c.mu.Lock()
+	c.entries[key] = &entry
+	c.dirty = true
+	c.mu.Unlock()
+
+	return &entry, nil
+}
+
+// Prune drops the entries of zettels that no longer exist and returns their paths.
+func (c *Cache) Prune() ([]string, error) {
+	zettels, err := c.kasten.List()
+	if err != nil {
+		return nil, err
+	}
+	present := map[string]bool{}
+	for _, z := range zettels {
+		present[c.key(z)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var pruned []string
+	for key := range c.entries {
+		if !present[key] {
+			delete(c.entries, key)
+			pruned = append(pruned, key)
+		}
+	}
+	if len(pruned) > 0 {
+		c.dirty = true
+	}
+	sort.Strings(pruned)
+	return pruned, nil
+}
+
+// Clear drops all entries
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]*Entry{}
+	c.dirty = true
+}
+
+// Cached returns the stored entry of a zettel without checking whether it is
+// still up to date, or nil if there is none.
+func (c *Cache) Cached(zettel string) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[c.key(zettel)]
+}
+
+// Paths returns the keys of all cached entries, sorted.
+func (c *Cache) Paths() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	paths := make([]string, 0, len(c.entries))
+	for key := range c.entries {
+		paths = append(paths, key)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// stampOf returns the stamp of the source or the tags file of an entry
+func stampOf(entry *Entry, tags bool) Stamp {
+	if entry == nil {
+		return Stamp{}
+	}
+	if tags {
+		return entry.TagFile
+	}
+	return entry.Source
+}
+
+// refresh returns the current stamp of a file and whether it differs from the
+// old one. The content is only read (and returned) if size or modification
+// time changed. A missing file has an empty stamp.
+func refresh(path string, old Stamp) (Stamp, []byte, bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Stamp{}, nil, old != Stamp{}, err
+	}
+
+	stamp := Stamp{ModTime: info.ModTime().UnixNano(), Size: info.Size()}
+	if old.ModTime == stamp.ModTime && old.Size == stamp.Size {
+		stamp.Hash = old.Hash
+		return stamp, nil, false, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Stamp{}, nil, false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	stamp.Hash = HashBytes(content)
+	return stamp, content, true, nil
+}
+
+// HashBytes returns the hex encoded sha256 of a file content
+func HashBytes(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
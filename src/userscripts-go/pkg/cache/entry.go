@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"os"
+	"strings"
+	"xk/src/userscripts-go/pkg/flashcard"
+	"xk/src/userscripts-go/pkg/references"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// Card is a flashcard or a cloze card defined in a zettel
+type Card struct {
+	ID        string
+	Kind      string // flashcard.KindBasic or flashcard.KindCloze
+	Deletions int    // number of deletions of a cloze card
+	Hash      string // flashcard.HashSides of the rendered fronts and backs
+	Start     uint32 // byte range of the environment in the zettel file
+	End       uint32
+}
+
+// Files returns the names of the card files gencards writes for the card.
+func (c Card) Files() []flashcard.CardFiles {
+	return flashcard.Files(c.Kind, c.ID, c.Deletions)
+}
+
+// Entry holds what was extracted from one zettel file
+type Entry struct {
+	Path    string // zettel file relative to ZETTEL_DATA
+	Source  Stamp  // the zettel file
+	TagFile Stamp  // the tags file, empty if there is none
+	Config  string // fingerprint of the reference and layout configuration used for the extraction
+
+	Occurrences  []references.Occurrence // citations in order of appearance, not validated
+	Tags         []string
+	Cards        []Card   // well-formed flashcards followed by well-formed cloze cards
+	Malformed    []string // ids of the card environments that could not be read
+	Labels       []string
+	Title        string // from \title or the first heading, may be empty
+	SyntaxErrors int
+}
+
+// References returns the cited zettels in order of first occurrence.
+func (e *Entry) References() []string {
+	return references.Targets(e.Occurrences)
+}
+
+// CardIDs returns the ids of the flashcards and cloze cards of the zettel,
+// including those of malformed cards.
+func (e *Entry) CardIDs() []string {
+	ids := make([]string, 0, len(e.Cards)+len(e.Malformed))
+	for _, card := range e.Cards {
+		ids = append(ids, card.ID)
+	}
+	return append(ids, e.Malformed...)
+}
+
+// Parser extracts cache entries from zettel files. It is not safe for
+// concurrent use; create one per goroutine.
+type Parser struct {
+	parser *sitter.Parser
+	refs   *references.Extractor
+	config string
+}
+
+// NewParser creates a parser with the reference and layout configuration from the environment.
+func NewParser(lang *sitter.Language) (*Parser, error) {
+	refs, err := references.NewExtractor(lang)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := sitter.NewParser()
+	parser.SetLanguage(lang)
+
+	// titles and reference contexts depend on the layout commands
+	config := HashBytes([]byte(os.Getenv("TS_QUERY_REF") + "\x00" + strings.Join(refs.Commands, " ") +
+		"\x00" + os.Getenv("LAYOUT_COMMANDS")))
+	return &Parser{parser: parser, refs: refs, config: config}, nil
+}
+
+// Close releases the parser and the compiled query.
+func (p *Parser) Close() {
+	p.refs.Close()
+	p.parser.Close()
+}
+
+// Parse extracts an entry from the source of a zettel. The stamps are left empty.
+func (p *Parser) Parse(zettel string, source []byte) Entry {
+	tree := p.parser.Parse(nil, source)
+	defer tree.Close()
+	root := tree.RootNode()
+
+	entry := Entry{
+		Config:       p.config,
+		Occurrences:  p.refs.Occurrences(root, source),
+		Labels:       findLabels(root, source),
+		Title:        treesitter.Title(root, source),
+		SyntaxErrors: len(treesitter.FindErrors(root)),
+	}
+
+	if document := treesitter.FindDocument(root, source); document != nil {
+		preamble := string(source[:document.StartByte()])
+		for _, env := range treesitter.FindGenericEnvironment(root, source, "flashcard") {
+			card, err := flashcard.EnvToFlashcard(env, source)
+			if err != nil {
+				entry.malformed(env, source)
+				continue
+			}
+			entry.Cards = append(entry.Cards, newCard(flashcard.KindBasic, card.ID, env, preamble,
+				[]string{card.Front}, []string{card.Back}))
+		}
+		for _, env := range treesitter.FindGenericEnvironment(root, source, "clozecard") {
+			card, err := flashcard.EnvToClozeCard(env, source)
+			if err != nil {
+				entry.malformed(env, source)
+				continue
+			}
+			var fronts, backs []string
+			for _, deletion := range card.Deletions {
+				fronts = append(fronts, deletion.Front)
+				backs = append(backs, deletion.Back)
+			}
+			entry.Cards = append(entry.Cards, newCard(flashcard.KindCloze, card.ID, env, preamble, fronts, backs))
+		}
+	}
+
+	return entry
+}
+
+// malformed records the id of a card environment that could not be read, so
+// that its note is not pruned and its id is not assigned again
+func (e *Entry) malformed(env treesitter.GenericEnvironment, source []byte) {
+	if id, ok := flashcard.EnvID(env, source); ok {
+		e.Malformed = append(e.Malformed, id)
+	}
+}
+
+// newCard describes a card with one pair of sides per deletion like the
+// manifest gencards writes for it
+func newCard(kind, id string, env treesitter.GenericEnvironment, preamble string, fronts, backs []string) Card {
+	var frontBytes, backBytes [][]byte
+	for i := range fronts {
+		frontBytes = append(frontBytes, []byte(flashcard.Render(preamble, fronts[i])))
+		backBytes = append(backBytes, []byte(flashcard.Render(preamble, backs[i])))
+	}
+	card := Card{
+		ID:    id,
+		Kind:  kind,
+		Hash:  flashcard.HashSides(frontBytes, backBytes),
+		Start: env.EnvironmentNode.StartByte(),
+		End:   env.EnvironmentNode.EndByte(),
+	}
+	if kind == flashcard.KindCloze {
+		card.Deletions = len(fronts)
+	}
+	return card
+}
+
+// findLabels returns the names of all \label definitions
+func findLabels(node *sitter.Node, source []byte) []string {
+	var labels []string
+	if node.Type() == "label_definition" {
+		if name := node.ChildByFieldName("name"); name != nil {
+			labels = append(labels, strings.TrimSpace(strings.Trim(name.Content(source), "{}")))
+		}
+		return labels
+	}
+	for i := 0; i < int(node.ChildCount()); i++ {
+		labels = append(labels, findLabels(node.Child(i), source)...)
+	}
+	return labels
+}
@@ -0,0 +1,786 @@
+package fakeanki
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Anki is an in-memory stand-in for AnkiConnect. It implements the actions
+// syncanki uses on decks, note types, notes, cards, reviews and media files,
+// either through Request, which matches the API interface of syncanki, or over
+// HTTP. It is safe for concurrent use.
+type Anki struct {
+	mu     sync.Mutex
+	nextID int
+	decks  map[string]int
+	models map[string]*Model
+	notes  map[int]*Note
+	cards  map[int]*Card
+	media  map[string][]byte
+
+	// Requests counts the requests per action, actions inside multi included
+	Requests map[string]int
+}
+
+// Model is a note type
+type Model struct {
+	Name      string
+	Fields    []string
+	IsCloze   bool
+	Templates []map[string]string
+	CSS       string
+}
+
+// Note is a note with its field values
+type Note struct {
+	ID     int
+	Model  string
+	Fields map[string]string
+	Tags   []string
+	Cards  []int
+}
+
+// Card is a card generated from a note
+type Card struct {
+	ID        int
+	Note      int
+	Deck      string
+	Ord       int // template or cloze number, starting at 0
+	Suspended bool
+
+	// scheduling state, changed by Answer
+	Interval int // in days, 0 for new and learning cards
+	Factor   int // ease in permille, 0 for new cards
+	Reps     int
+	Lapses   int
+	Reviews  []Review
+}
+
+// Review is an entry of the review log of a card
+type Review struct {
+	ID           int // unique and increasing, like the review time of Anki
+	Ease         int // 1 (again) to 4 (easy)
+	Interval     int
+	LastInterval int
+	Factor       int
+	Type         int // 0 learn, 1 review
+}
+
+// LeechThreshold is the number of lapses that make a card a leech
+const LeechThreshold = 8
+
+// New returns an empty collection with the Default deck
+func New() *Anki {
+	return &Anki{
+		nextID:   1_500_000_000_000,
+		decks:    map[string]int{"Default": 1},
+		models:   map[string]*Model{},
+		notes:    map[int]*Note{},
+		cards:    map[int]*Card{},
+		media:    map[string][]byte{},
+		Requests: map[string]int{},
+	}
+}
+
+// request is the body of an AnkiConnect request, also used for the actions of multi
+type request struct {
+	Action  string          `json:"action"`
+	Version int             `json:"version"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// response is the body of an AnkiConnect response
+type response struct {
+	Result any `json:"result"`
+	Error  any `json:"error"`
+}
+
+// Request performs an action the way AnkiConnect does, including the JSON
+// round trip of parameters and response.
+func (a *Anki) Request(action string, params any, result any) error {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+
+	res := a.perform(request{Action: action, Version: 6, Params: raw})
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, result)
+}
+
+// ServeHTTP answers AnkiConnect requests
+func (a *Anki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.perform(req))
+}
+
+// Server starts an HTTP server answering AnkiConnect requests on a local port.
+// Its URL can be used as ANKI_CONNECT_URL; close it when done.
+func (a *Anki) Server() *httptest.Server {
+	return httptest.NewServer(a)
+}
+
+// perform runs an action and wraps its result or error
+func (a *Anki) perform(req request) response {
+	if req.Action == "multi" {
+		var params struct {
+			Actions []request `json:"actions"`
+		}
+		if err := decode(req.Params, &params); err != nil {
+			return response{Error: err.Error()}
+		}
+		results := make([]response, len(params.Actions))
+		for i, action := range params.Actions {
+			results[i] = a.perform(action)
+		}
+		a.count("multi")
+		return response{Result: results}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Requests[req.Action]++
+
+	handler, ok := handlers[req.Action]
+	if !ok {
+		return response{Error: "unsupported action"}
+	}
+	result, err := handler(a, req.Params)
+	if err != nil {
+		return response{Error: err.Error()}
+	}
+	return response{Result: result}
+}
+
+// count records a request that is not handled under the lock
+func (a *Anki) count(action string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Requests[action]++
+}
+
+// decode unmarshals the parameters of an action, missing parameters are fine
+func decode(raw json.RawMessage, params any) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	return json.Unmarshal(raw, params)
+}
+
+// handlers implement the actions, they are called with the lock held
+var handlers = map[string]func(*Anki, json.RawMessage) (any, error){
+	"version": func(a *Anki, raw json.RawMessage) (any, error) {
+		return 6, nil
+	},
+
+	"deckNames": func(a *Anki, raw json.RawMessage) (any, error) {
+		names := make([]string, 0, len(a.decks))
+		for name := range a.decks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	},
+
+	"createDeck": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Deck string `json:"deck"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		if id, ok := a.decks[params.Deck]; ok {
+			return id, nil
+		}
+		a.decks[params.Deck] = a.id()
+		return a.decks[params.Deck], nil
+	},
+
+	"modelNames": func(a *Anki, raw json.RawMessage) (any, error) {
+		names := make([]string, 0, len(a.models))
+		for name := range a.models {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, nil
+	},
+
+	"createModel": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			ModelName     string              `json:"modelName"`
+			InOrderFields []string            `json:"inOrderFields"`
+			IsCloze       bool                `json:"isCloze"`
+			CardTemplates []map[string]string `json:"cardTemplates"`
+			CSS           string              `json:"css"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		if _, ok := a.models[params.ModelName]; ok {
+			return nil, fmt.Errorf("Model name already exists")
+		}
+		a.models[params.ModelName] = &Model{
+			Name:      params.ModelName,
+			Fields:    params.InOrderFields,
+			IsCloze:   params.IsCloze,
+			Templates: params.CardTemplates,
+			CSS:       params.CSS,
+		}
+		return map[string]any{"name": params.ModelName}, nil
+	},
+
+	"findCards": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Query string `json:"query"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		match, err := parseQuery(params.Query)
+		if err != nil {
+			return nil, err
+		}
+		ids := []int{}
+		for _, card := range a.cards {
+			if match(a, a.notes[card.Note], card) {
+				ids = append(ids, card.ID)
+			}
+		}
+		sort.Ints(ids) // ascending ids are the order of creation
+		return ids, nil
+	},
+
+	"findNotes": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Query string `json:"query"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		match, err := parseQuery(params.Query)
+		if err != nil {
+			return nil, err
+		}
+		ids := []int{}
+		for _, note := range a.notes {
+			for _, cardID := range note.Cards {
+				if match(a, note, a.cards[cardID]) {
+					ids = append(ids, note.ID)
+					break
+				}
+			}
+		}
+		sort.Ints(ids)
+		return ids, nil
+	},
+
+	"cardsToNotes": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Cards []int `json:"cards"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		seen := map[int]bool{}
+		ids := []int{}
+		for _, id := range params.Cards {
+			if card, ok := a.cards[id]; ok && !seen[card.Note] {
+				seen[card.Note] = true
+				ids = append(ids, card.Note)
+			}
+		}
+		sort.Ints(ids)
+		return ids, nil
+	},
+
+	"notesInfo": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Notes []int `json:"notes"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		infos := []any{}
+		for _, id := range params.Notes {
+			note, ok := a.notes[id]
+			if !ok {
+				// AnkiConnect answers with an empty object for unknown notes
+				infos = append(infos, map[string]any{})
+				continue
+			}
+			fields := map[string]any{}
+			for i, name := range a.models[note.Model].Fields {
+				fields[name] = map[string]any{"value": note.Fields[name], "order": i}
+			}
+			infos = append(infos, map[string]any{
+				"noteId":    note.ID,
+				"modelName": note.Model,
+				"tags":      append([]string{}, note.Tags...),
+				"fields":    fields,
+				"cards":     append([]int{}, note.Cards...),
+			})
+		}
+		return infos, nil
+	},
+
+	"addNote": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Note struct {
+				DeckName  string            `json:"deckName"`
+				ModelName string            `json:"modelName"`
+				Fields    map[string]string `json:"fields"`
+				Tags      []string          `json:"tags"`
+				Options   struct {
+					AllowDuplicate bool   `json:"allowDuplicate"`
+					DuplicateScope string `json:"duplicateScope"`
+				} `json:"options"`
+			} `json:"note"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		n := params.Note
+		if _, ok := a.decks[n.DeckName]; !ok {
+			return nil, fmt.Errorf("deck was not found: %s", n.DeckName)
+		}
+		model, ok := a.models[n.ModelName]
+		if !ok {
+			return nil, fmt.Errorf("model was not found: %s", n.ModelName)
+		}
+
+		fields := map[string]string{}
+		for _, name := range model.Fields {
+			fields[name] = ""
+		}
+		for name, value := range n.Fields {
+			if _, ok := fields[name]; !ok {
+				return nil, fmt.Errorf("%s has no field %s", n.ModelName, name)
+			}
+			fields[name] = value
+		}
+
+		first := fields[model.Fields[0]]
+		if first == "" {
+			return nil, fmt.Errorf("cannot create note because it is empty")
+		}
+		// notes of the same type with the same first field are duplicates, in
+		// the whole collection or only in the deck of the new note
+		for _, other := range a.notes {
+			if n.Options.AllowDuplicate || other.Model != model.Name || other.Fields[model.Fields[0]] != first {
+				continue
+			}
+			if n.Options.DuplicateScope == "deck" && a.cards[other.Cards[0]].Deck != n.DeckName {
+				continue
+			}
+			return nil, fmt.Errorf("cannot create note because it is a duplicate")
+		}
+
+		note := &Note{ID: a.id(), Model: model.Name, Fields: fields, Tags: n.Tags}
+		a.generateCards(note, n.DeckName)
+		if len(note.Cards) == 0 {
+			return nil, fmt.Errorf("cannot create note because it is empty")
+		}
+		a.notes[note.ID] = note
+		return note.ID, nil
+	},
+
+	"updateNoteFields": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Note struct {
+				ID     int               `json:"id"`
+				Fields map[string]string `json:"fields"`
+			} `json:"note"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		note, ok := a.notes[params.Note.ID]
+		if !ok {
+			return nil, fmt.Errorf("Note was not found: %d", params.Note.ID)
+		}
+		for name, value := range params.Note.Fields {
+			if _, ok := note.Fields[name]; ok {
+				note.Fields[name] = value
+			}
+		}
+		// like Anki, cards of new clozes are added but none are removed
+		a.generateCards(note, a.cards[note.Cards[0]].Deck)
+		return nil, nil
+	},
+
+	"deleteNotes": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Notes []int `json:"notes"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		for _, id := range params.Notes {
+			if note, ok := a.notes[id]; ok {
+				for _, cardID := range note.Cards {
+					delete(a.cards, cardID)
+				}
+				delete(a.notes, id)
+			}
+		}
+		return nil, nil
+	},
+
+	"suspend": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Cards []int `json:"cards"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		changed := false
+		for _, id := range params.Cards {
+			if card, ok := a.cards[id]; ok && !card.Suspended {
+				card.Suspended = true
+				changed = true
+			}
+		}
+		return changed, nil
+	},
+
+	"storeMediaFile": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Filename string `json:"filename"`
+			Data     string `json:"data"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		data, err := base64.StdEncoding.DecodeString(params.Data)
+		if err != nil {
+			return nil, err
+		}
+		a.media[params.Filename] = data
+		return params.Filename, nil
+	},
+
+	"getMediaFilesNames": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Pattern string `json:"pattern"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		if params.Pattern == "" {
+			params.Pattern = "*"
+		}
+		names := []string{}
+		for name := range a.media {
+			ok, err := path.Match(params.Pattern, name)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names, nil
+	},
+
+	"deleteMediaFile": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Filename string `json:"filename"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		delete(a.media, params.Filename)
+		return nil, nil
+	},
+
+	"cardsInfo": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Cards []int `json:"cards"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		infos := []map[string]any{}
+		for _, id := range params.Cards {
+			card, ok := a.cards[id]
+			if !ok {
+				// AnkiConnect answers unknown cards with an empty object
+				infos = append(infos, map[string]any{})
+				continue
+			}
+			queue, kind := 0, 0
+			if card.Interval > 0 {
+				queue, kind = 2, 2
+			}
+			if card.Suspended {
+				queue = -1
+			}
+			infos = append(infos, map[string]any{
+				"cardId":    card.ID,
+				"note":      card.Note,
+				"deckName":  card.Deck,
+				"modelName": a.notes[card.Note].Model,
+				"ord":       card.Ord,
+				"interval":  card.Interval,
+				"factor":    card.Factor,
+				"reps":      card.Reps,
+				"lapses":    card.Lapses,
+				"type":      kind,
+				"queue":     queue,
+			})
+		}
+		return infos, nil
+	},
+
+	"getReviewsOfCards": func(a *Anki, raw json.RawMessage) (any, error) {
+		// the card ids may be numbers or strings
+		var params struct {
+			Cards []json.Number `json:"cards"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		result := map[string]any{}
+		for _, number := range params.Cards {
+			id, err := strconv.Atoi(number.String())
+			if err != nil {
+				return nil, fmt.Errorf("invalid card id %q", number)
+			}
+			reviews := []map[string]any{}
+			if card, ok := a.cards[id]; ok {
+				for _, r := range card.Reviews {
+					reviews = append(reviews, map[string]any{
+						"id":      r.ID,
+						"usn":     -1,
+						"ease":    r.Ease,
+						"ivl":     r.Interval,
+						"lastIvl": r.LastInterval,
+						"factor":  r.Factor,
+						"time":    10000,
+						"type":    r.Type,
+					})
+				}
+			}
+			result[number.String()] = reviews
+		}
+		return result, nil
+	},
+
+	"retrieveMediaFile": func(a *Anki, raw json.RawMessage) (any, error) {
+		var params struct {
+			Filename string `json:"filename"`
+		}
+		if err := decode(raw, &params); err != nil {
+			return nil, err
+		}
+		data, ok := a.media[params.Filename]
+		if !ok {
+			return false, nil
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+	},
+}
+
+// id returns a new unique id
+func (a *Anki) id() int {
+	a.nextID++
+	return a.nextID
+}
+
+// clozePattern finds the cloze numbers in a field
+var clozePattern = regexp.MustCompile(`\{\{c(\d+)::`)
+
+// generateCards adds the cards a note is missing: one per template of a
+// standard note type, one per cloze number of a cloze note type
+func (a *Anki) generateCards(note *Note, deck string) {
+	model := a.models[note.Model]
+
+	ords := map[int]bool{}
+	if model.IsCloze {
+		for _, value := range note.Fields {
+			for _, m := range clozePattern.FindAllStringSubmatch(value, -1) {
+				if n, err := strconv.Atoi(m[1]); err == nil && n > 0 {
+					ords[n-1] = true
+				}
+			}
+		}
+	} else {
+		for i := range model.Templates {
+			ords[i] = true
+		}
+	}
+	for _, id := range note.Cards {
+		delete(ords, a.cards[id].Ord)
+	}
+
+	var missing []int
+	for ord := range ords {
+		missing = append(missing, ord)
+	}
+	sort.Ints(missing)
+	for _, ord := range missing {
+		card := &Card{ID: a.id(), Note: note.ID, Deck: deck, Ord: ord}
+		a.cards[card.ID] = card
+		note.Cards = append(note.Cards, card.ID)
+	}
+}
+
+// Notes returns copies of all notes, ordered by id
+func (a *Anki) Notes() []Note {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	notes := make([]Note, 0, len(a.notes))
+	for _, note := range a.notes {
+		n := *note
+		n.Fields = map[string]string{}
+		for name, value := range note.Fields {
+			n.Fields[name] = value
+		}
+		n.Tags = append([]string{}, note.Tags...)
+		n.Cards = append([]int{}, note.Cards...)
+		notes = append(notes, n)
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].ID < notes[j].ID })
+	return notes
+}
+
+// Cards returns copies of the cards of a note, ordered by id
+func (a *Anki) Cards(noteID int) []Card {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cards []Card
+	if note, ok := a.notes[noteID]; ok {
+		for _, id := range note.Cards {
+			card := *a.cards[id]
+			card.Reviews = append([]Review{}, card.Reviews...)
+			cards = append(cards, card)
+		}
+	}
+	return cards
+}
+
+// Model returns a copy of a note type and whether it exists
+func (a *Anki) Model(name string) (Model, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	model, ok := a.models[name]
+	if !ok {
+		return Model{}, false
+	}
+	return *model, true
+}
+
+// Media returns the content of a media file and whether it exists
+func (a *Anki) Media(filename string) ([]byte, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	data, ok := a.media[filename]
+	return data, ok
+}
+
+// MediaNames returns the names of all media files, sorted
+func (a *Anki) MediaNames() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	names := make([]string, 0, len(a.media))
+	for name := range a.media {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Answer reviews a card with a button from 1 (again) to 4 (easy), with a
+// simplified version of Anki's scheduler. Again resets the interval and is a
+// lapse if the card was learned; a card lapsing LeechThreshold times tags its
+// note as leech.
+func (a *Anki) Answer(cardID, ease int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	card, ok := a.cards[cardID]
+	if !ok {
+		return fmt.Errorf("card was not found: %d", cardID)
+	}
+	if ease < 1 || ease > 4 {
+		return fmt.Errorf("invalid ease %d", ease)
+	}
+
+	review := Review{ID: a.id(), Ease: ease, LastInterval: card.Interval}
+	if card.Interval > 0 {
+		review.Type = 1
+	}
+	if card.Factor == 0 {
+		card.Factor = 2500
+	}
+
+	switch {
+	case ease == 1:
+		if card.Interval > 0 {
+			card.Lapses++
+			card.Factor = max(1300, card.Factor-200)
+			if card.Lapses == LeechThreshold {
+				note := a.notes[card.Note]
+				note.Tags = append(note.Tags, "leech")
+			}
+		}
+		card.Interval = 0
+	case card.Interval == 0:
+		card.Interval = 1
+		if ease == 4 {
+			card.Interval = 4
+		}
+	case ease == 2:
+		card.Interval = max(card.Interval+1, card.Interval*12/10)
+		card.Factor = max(1300, card.Factor-150)
+	case ease == 3:
+		card.Interval = max(card.Interval+1, card.Interval*card.Factor/1000)
+	case ease == 4:
+		card.Interval = max(card.Interval+1, card.Interval*card.Factor*13/10000)
+		card.Factor += 150
+	}
+	card.Reps++
+
+	review.Interval, review.Factor = card.Interval, card.Factor
+	card.Reviews = append(card.Reviews, review)
+	return nil
+}
+
+// SetField changes a field of a note the way a user editing it in Anki
+// would, e.g. to write a fixme.
+func (a *Anki) SetField(noteID int, field, value string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	note, ok := a.notes[noteID]
+	if !ok {
+		return fmt.Errorf("note was not found: %d", noteID)
+	}
+	if _, ok := note.Fields[field]; !ok {
+		return fmt.Errorf("note %d has no field %s", noteID, field)
+	}
+	note.Fields[field] = value
+	return nil
+}
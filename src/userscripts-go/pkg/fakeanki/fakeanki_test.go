@@ -0,0 +1,338 @@
+package fakeanki
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// call performs an action and returns its result, failing the test on an error
+func call(t *testing.T, a *Anki, action string, params any) json.RawMessage {
+	t.Helper()
+	res, err := tryCall(a, action, params)
+	if err != nil {
+		t.Fatalf("%s: %v", action, err)
+	}
+	return res
+}
+
+// tryCall performs an action and returns its result or its error
+func tryCall(a *Anki, action string, params any) (json.RawMessage, error) {
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  any             `json:"error"`
+	}
+	if err := a.Request(action, params, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("%v", res.Error)
+	}
+	return res.Result, nil
+}
+
+// addNote adds a note and returns its id
+func addNote(t *testing.T, a *Anki, deck, model string, fields map[string]string) int {
+	t.Helper()
+	var id int
+	res := call(t, a, "addNote", map[string]any{
+		"note": map[string]any{"deckName": deck, "modelName": model, "fields": fields},
+	})
+	if err := json.Unmarshal(res, &id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// newCollection returns a collection with a few decks and the note types
+// Basic (Front, Back) and Cloze (Text, Extra)
+func newCollection(t *testing.T) *Anki {
+	t.Helper()
+	a := New()
+	for _, deck := range []string{"Math", "Math::Algebra", "Math Notes", "Mathematics"} {
+		call(t, a, "createDeck", map[string]any{"deck": deck})
+	}
+	call(t, a, "createModel", map[string]any{
+		"modelName":     "Basic",
+		"inOrderFields": []string{"Front", "Back"},
+		"cardTemplates": []map[string]string{{"Front": "{{Front}}", "Back": "{{Back}}"}},
+	})
+	call(t, a, "createModel", map[string]any{
+		"modelName":     "Cloze",
+		"inOrderFields": []string{"Text", "Extra"},
+		"isCloze":       true,
+		"cardTemplates": []map[string]string{{"Front": "{{cloze:Text}}", "Back": "{{cloze:Text}}"}},
+	})
+	return a
+}
+
+func TestAddNote(t *testing.T) {
+	tests := []struct {
+		name   string
+		deck   string
+		model  string
+		fields map[string]string
+		err    string // part of the error, empty if the note is added
+	}{
+		{"new", "Math", "Basic", map[string]string{"Front": "coset", "Back": "gH"}, ""},
+		{"duplicate", "Math", "Basic", map[string]string{"Front": "kernel", "Back": "other"}, "duplicate"},
+		{"duplicate in other deck", "Mathematics", "Basic", map[string]string{"Front": "kernel"}, "duplicate"},
+		{"same front in other note type", "Math", "Cloze", map[string]string{"Text": "kernel {{c1::x}}"}, ""},
+		{"empty first field", "Math", "Basic", map[string]string{"Back": "no front"}, "empty"},
+		{"cloze without deletions", "Math", "Cloze", map[string]string{"Text": "no clozes"}, "empty"},
+		{"unknown field", "Math", "Basic", map[string]string{"Front": "ring", "Hint": "x"}, "no field Hint"},
+		{"unknown deck", "Physics", "Basic", map[string]string{"Front": "force"}, "deck was not found"},
+		{"unknown note type", "Math", "Reversed", map[string]string{"Front": "force"}, "model was not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newCollection(t)
+			addNote(t, a, "Math", "Basic", map[string]string{"Front": "kernel", "Back": "of a map"})
+
+			_, err := tryCall(a, "addNote", map[string]any{
+				"note": map[string]any{"deckName": tt.deck, "modelName": tt.model, "fields": tt.fields},
+			})
+			if tt.err == "" && err != nil {
+				t.Fatalf("note was not added: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("got error %v, want one containing %q", err, tt.err)
+			}
+
+			want := 1
+			if tt.err == "" {
+				want = 2
+			}
+			if notes := a.Notes(); len(notes) != want {
+				t.Fatalf("got %d notes, want %d", len(notes), want)
+			}
+		})
+	}
+}
+
+func TestClozeCards(t *testing.T) {
+	a := newCollection(t)
+	id := addNote(t, a, "Math", "Cloze", map[string]string{"Text": "{{c1::normal}} {{c2::subgroup}} {{c1::again}}"})
+	if cards := a.Cards(id); len(cards) != 2 || cards[0].Ord != 0 || cards[1].Ord != 1 {
+		t.Fatalf("want one card per cloze number, got %+v", cards)
+	}
+
+	// like Anki, new clozes get cards and the cards of removed ones stay
+	call(t, a, "updateNoteFields", map[string]any{
+		"note": map[string]any{"id": id, "fields": map[string]string{"Text": "{{c3::normal}} subgroup"}},
+	})
+	if cards := a.Cards(id); len(cards) != 3 || cards[2].Ord != 2 || cards[2].Deck != "Math" {
+		t.Fatalf("updated note has cards %+v", cards)
+	}
+}
+
+func TestNotesInfo(t *testing.T) {
+	a := newCollection(t)
+	id := addNote(t, a, "Math", "Basic", map[string]string{"Front": "kernel", "Back": "of a map"})
+
+	var infos []struct {
+		NoteID    int    `json:"noteId"`
+		ModelName string `json:"modelName"`
+		Fields    map[string]struct {
+			Value string `json:"value"`
+			Order int    `json:"order"`
+		} `json:"fields"`
+		Cards []int `json:"cards"`
+	}
+	res := call(t, a, "notesInfo", map[string]any{"notes": []int{id, 42}})
+	if err := json.Unmarshal(res, &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("want a result per requested note, got %+v", infos)
+	}
+	if info := infos[0]; info.NoteID != id || info.ModelName != "Basic" ||
+		info.Fields["Back"].Value != "of a map" || info.Fields["Back"].Order != 1 || len(info.Cards) != 1 {
+		t.Errorf("wrong info of note %d: %+v", id, info)
+	}
+	if infos[1].NoteID != 0 {
+		t.Errorf("missing note has info %+v", infos[1])
+	}
+}
+
+func TestDeleteAndSuspend(t *testing.T) {
+	a := newCollection(t)
+	kernel := addNote(t, a, "Math", "Basic", map[string]string{"Front": "kernel"})
+	image := addNote(t, a, "Math", "Basic", map[string]string{"Front": "image"})
+
+	card := a.Cards(image)[0].ID
+	var changed bool
+	if err := json.Unmarshal(call(t, a, "suspend", map[string]any{"cards": []int{card}}), &changed); err != nil || !changed {
+		t.Fatalf("suspending card %d changed nothing: %v", card, err)
+	}
+	if err := json.Unmarshal(call(t, a, "suspend", map[string]any{"cards": []int{card}}), &changed); err != nil || changed {
+		t.Fatalf("suspending card %d twice changed it: %v", card, err)
+	}
+	if !a.Cards(image)[0].Suspended {
+		t.Fatal("card is not suspended")
+	}
+
+	call(t, a, "deleteNotes", map[string]any{"notes": []int{kernel, 42}})
+	notes := a.Notes()
+	if len(notes) != 1 || notes[0].ID != image {
+		t.Fatalf("notes left after deleting %d: %+v", kernel, notes)
+	}
+	if cards := a.Cards(kernel); len(cards) != 0 {
+		t.Fatalf("cards of the deleted note are left: %+v", cards)
+	}
+}
+
+func TestMedia(t *testing.T) {
+	a := newCollection(t)
+	call(t, a, "storeMediaFile", map[string]any{"filename": "xk_a.svg", "data": "PHN2Zy8+"})
+
+	var data string
+	if err := json.Unmarshal(call(t, a, "retrieveMediaFile", map[string]any{"filename": "xk_a.svg"}), &data); err != nil {
+		t.Fatal(err)
+	}
+	if content, ok := a.Media("xk_a.svg"); !ok || string(content) != "<svg/>" || data != "PHN2Zy8+" {
+		t.Fatalf("stored media file has content %q (%q)", content, data)
+	}
+
+	var missing bool
+	if err := json.Unmarshal(call(t, a, "retrieveMediaFile", map[string]any{"filename": "xk_b.svg"}), &missing); err != nil || missing {
+		t.Fatalf("missing media file is not answered with false: %v", err)
+	}
+}
+
+func TestMediaNames(t *testing.T) {
+	a := newCollection(t)
+	for _, name := range []string{"xk_a.svg", "xk_b.svg", "plot.png"} {
+		call(t, a, "storeMediaFile", map[string]any{"filename": name, "data": "PHN2Zy8+"})
+	}
+	call(t, a, "deleteMediaFile", map[string]any{"filename": "xk_a.svg"})
+
+	var names []string
+	if err := json.Unmarshal(call(t, a, "getMediaFilesNames", map[string]any{"pattern": "*.svg"}), &names); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"xk_b.svg"}) {
+		t.Fatalf("got media files %v", names)
+	}
+}
+
+func TestMulti(t *testing.T) {
+	a := newCollection(t)
+	res := call(t, a, "multi", map[string]any{"actions": []map[string]any{
+		{"action": "deckNames"},
+		{"action": "createDeck", "params": map[string]any{"deck": "Physics"}},
+		{"action": "explode"},
+	}})
+
+	var results []struct {
+		Result json.RawMessage `json:"result"`
+		Error  any             `json:"error"`
+	}
+	if err := json.Unmarshal(res, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || results[0].Error != nil || results[1].Error != nil || results[2].Error == nil {
+		t.Fatalf("want the responses of all actions in order, got %+v", results)
+	}
+	var decks []string
+	if err := json.Unmarshal(results[0].Result, &decks); err != nil || !reflect.DeepEqual(decks,
+		[]string{"Default", "Math", "Math Notes", "Math::Algebra", "Mathematics"}) {
+		t.Fatalf("deckNames inside multi: %s, %v", results[0].Result, err)
+	}
+	if a.Requests["multi"] != 1 || a.Requests["createDeck"] != 5 {
+		t.Errorf("requests inside multi are not counted: %v", a.Requests)
+	}
+}
+
+func TestAddNoteDuplicateOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		deck    string
+		options map[string]any
+		added   bool
+	}{
+		{"collection scope", "Mathematics", map[string]any{}, false},
+		{"deck scope, same deck", "Math", map[string]any{"duplicateScope": "deck"}, false},
+		{"deck scope, other deck", "Mathematics", map[string]any{"duplicateScope": "deck"}, true},
+		{"allowed", "Math", map[string]any{"allowDuplicate": true, "duplicateScope": "deck"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newCollection(t)
+			addNote(t, a, "Math", "Basic", map[string]string{"Front": "Definition?", "Back": "kernel"})
+
+			_, err := tryCall(a, "addNote", map[string]any{
+				"note": map[string]any{
+					"deckName":  tt.deck,
+					"modelName": "Basic",
+					"fields":    map[string]string{"Front": "Definition?", "Back": "image"},
+					"options":   tt.options,
+				},
+			})
+			if tt.added && err != nil {
+				t.Fatalf("duplicate was not added: %v", err)
+			}
+			if !tt.added && (err == nil || !strings.Contains(err.Error(), "duplicate")) {
+				t.Fatalf("got error %v, want a duplicate", err)
+			}
+		})
+	}
+}
+
+func TestAnswer(t *testing.T) {
+	a := newCollection(t)
+	id := addNote(t, a, "Math", "Basic", map[string]string{"Front": "kernel"})
+	card := a.Cards(id)[0].ID
+
+	if err := a.Answer(card, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Answer(card, 3); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < LeechThreshold; i++ {
+		if err := a.Answer(card, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.Answer(card, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var infos []struct {
+		Interval int `json:"interval"`
+		Lapses   int `json:"lapses"`
+		Reps     int `json:"reps"`
+		Factor   int `json:"factor"`
+	}
+	if err := json.Unmarshal(call(t, a, "cardsInfo", map[string]any{"cards": []int{card}}), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 || infos[0].Lapses != LeechThreshold || infos[0].Reps != 2+2*LeechThreshold ||
+		infos[0].Interval != 1 || infos[0].Factor != 1300 {
+		t.Fatalf("got scheduling %+v", infos)
+	}
+	if notes := a.Notes(); !reflect.DeepEqual(notes[0].Tags, []string{"leech"}) {
+		t.Errorf("note of a leech has tags %v", notes[0].Tags)
+	}
+
+	// the card ids of getReviewsOfCards are strings
+	var reviews map[string][]struct {
+		Ease int `json:"ease"`
+	}
+	res := call(t, a, "getReviewsOfCards", map[string]any{"cards": []string{fmt.Sprint(card)}})
+	if err := json.Unmarshal(res, &reviews); err != nil {
+		t.Fatal(err)
+	}
+	if log := reviews[fmt.Sprint(card)]; len(log) != 2+2*LeechThreshold || log[2].Ease != 1 {
+		t.Fatalf("got review log %+v", log)
+	}
+
+	if err := a.Answer(card, 5); err == nil {
+		t.Error("an ease of 5 is not an error")
+	}
+}
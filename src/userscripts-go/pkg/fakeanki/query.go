@@ -0,0 +1,227 @@
+package fakeanki
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// matcher decides whether a card, and the note it belongs to, matches a search
+type matcher func(a *Anki, note *Note, card *Card) bool
+
+// parseQuery compiles the subset of Anki's search syntax syncanki uses:
+// terms joined by spaces (and) or OR, parentheses, negation with -, and
+// deck:, note:, is:suspended and field:value terms with the _ and * wildcards.
+func parseQuery(query string) (matcher, error) {
+	p := &queryParser{tokens: tokenize(query)}
+	m, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("invalid search: unexpected %q", p.tokens[p.pos])
+	}
+	return m, nil
+}
+
+// tokenize splits a query into parentheses, quoted terms and plain terms.
+// Escapes with a backslash are kept for wildcard.
+func tokenize(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	flush := func() {
+		if current.Len() > 0 {
+			tokens = append(tokens, current.String())
+			current.Reset()
+		}
+	}
+	for _, r := range query {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			current.WriteRune(r)
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case quoted:
+			current.WriteRune(r)
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// queryParser is a recursive descent parser over the tokens of a query
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+// or parses terms joined by OR
+func (p *queryParser) or() (matcher, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos], "or") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(a *Anki, n *Note, c *Card) bool { return l(a, n, c) || right(a, n, c) }
+	}
+	return left, nil
+}
+
+// and parses terms joined by spaces or AND
+func (p *queryParser) and() (matcher, error) {
+	var terms []matcher
+	for p.pos < len(p.tokens) {
+		token := p.tokens[p.pos]
+		if token == ")" || strings.EqualFold(token, "or") {
+			break
+		}
+		if strings.EqualFold(token, "and") {
+			p.pos++
+			continue
+		}
+		term, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("invalid search: empty term")
+	}
+	return func(a *Anki, n *Note, c *Card) bool {
+		for _, term := range terms {
+			if !term(a, n, c) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// term parses a negated term, a group or a single search term
+func (p *queryParser) term() (matcher, error) {
+	token := p.tokens[p.pos]
+	p.pos++
+
+	if token == "-" || token == "(" || strings.HasPrefix(token, "-") {
+		negated := strings.HasPrefix(token, "-")
+		if negated {
+			if token = token[1:]; token == "" {
+				if p.pos == len(p.tokens) {
+					return nil, fmt.Errorf("invalid search: nothing to negate")
+				}
+				token = p.tokens[p.pos]
+				p.pos++
+			}
+		}
+
+		var inner matcher
+		if token == "(" {
+			m, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if p.pos == len(p.tokens) || p.tokens[p.pos] != ")" {
+				return nil, fmt.Errorf("invalid search: missing )")
+			}
+			p.pos++
+			inner = m
+		} else {
+			m, err := single(token)
+			if err != nil {
+				return nil, err
+			}
+			inner = m
+		}
+
+		if negated {
+			return func(a *Anki, n *Note, c *Card) bool { return !inner(a, n, c) }, nil
+		}
+		return inner, nil
+	}
+
+	return single(token)
+}
+
+// single compiles a search term without operators
+func single(token string) (matcher, error) {
+	name, value, ok := strings.Cut(token, ":")
+	if !ok {
+		return nil, fmt.Errorf("unsupported search term %q", token)
+	}
+	pattern, err := wildcard(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(name) {
+	case "deck":
+		// a deck matches its subdecks too
+		sub, err := wildcard(value + "::*")
+		if err != nil {
+			return nil, err
+		}
+		return func(a *Anki, n *Note, c *Card) bool {
+			return pattern.MatchString(c.Deck) || sub.MatchString(c.Deck)
+		}, nil
+	case "note":
+		return func(a *Anki, n *Note, c *Card) bool { return pattern.MatchString(n.Model) }, nil
+	case "is":
+		if strings.ToLower(value) != "suspended" {
+			return nil, fmt.Errorf("unsupported search term %q", token)
+		}
+		return func(a *Anki, n *Note, c *Card) bool { return c.Suspended }, nil
+	default:
+		return func(a *Anki, n *Note, c *Card) bool {
+			for field, v := range n.Fields {
+				if strings.EqualFold(field, name) {
+					return pattern.MatchString(v)
+				}
+			}
+			return false
+		}, nil
+	}
+}
+
+// wildcard compiles a search value, _ matches one character and * any number.
+// A backslash escapes the character after it.
+func wildcard(value string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	escaped := false
+	for _, r := range value {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '_':
+			expr.WriteString(".")
+		case r == '*':
+			expr.WriteString(".*")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
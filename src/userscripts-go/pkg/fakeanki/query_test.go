@@ -0,0 +1,135 @@
+package fakeanki
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newSearchCollection returns a collection with notes in several decks, the
+// card of coset is suspended
+func newSearchCollection(t *testing.T) *Anki {
+	t.Helper()
+	a := newCollection(t)
+	addNote(t, a, "Math", "Basic", map[string]string{"Front": "kernel", "Back": "of a homomorphism"})
+	addNote(t, a, "Math::Algebra", "Basic", map[string]string{"Front": "group"})
+	addNote(t, a, "Mathematics", "Basic", map[string]string{"Front": "ring_1"})
+	addNote(t, a, "Math Notes", "Cloze", map[string]string{"Text": "{{c1::normal}} subgroup"})
+	coset := addNote(t, a, "Math", "Basic", map[string]string{"Front": "coset"})
+	call(t, a, "suspend", map[string]any{"cards": []int{a.Cards(coset)[0].ID}})
+	return a
+}
+
+// search returns the first fields of the notes with a card matching the query, sorted
+func search(a *Anki, query string) ([]string, error) {
+	match, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, note := range a.notes {
+		for _, id := range note.Cards {
+			if match(a, note, a.cards[id]) {
+				found = append(found, note.Fields[a.models[note.Model].Fields[0]])
+				break
+			}
+		}
+	}
+	sort.Strings(found)
+	return found, nil
+}
+
+func TestParseQuery(t *testing.T) {
+	a := newSearchCollection(t)
+	cloze := "{{c1::normal}} subgroup"
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		// a deck matches its subdecks, but no other deck starting with its name
+		{"deck:Math", []string{"coset", "group", "kernel"}},
+		{"deck:math::algebra", []string{"group"}},
+		{`"deck:Math Notes"`, []string{cloze}},
+		{"deck:Math*", []string{"coset", "group", "kernel", "ring_1", cloze}},
+		{`"deck:Math\*"`, []string{}},
+
+		// and, or, groups and negation
+		{"deck:Math note:Basic", []string{"coset", "group", "kernel"}},
+		{"deck:Math and -deck:Math::Algebra", []string{"coset", "kernel"}},
+		{"note:Cloze OR front:group", []string{"group", cloze}},
+		{`"deck:Mathematics" or ("deck:Math Notes" OR is:suspended)`, []string{"coset", "ring_1", cloze}},
+		{"deck:Math -(is:suspended OR front:kernel)", []string{"group"}},
+		{"- note:Basic", []string{cloze}},
+
+		// field values ignore case, _ matches one character and * any number
+		{"front:KERNEL", []string{"kernel"}},
+		{"front:k*", []string{"kernel"}},
+		{"front:*e*", []string{"coset", "kernel"}},
+		{"front:r_ng_1", []string{"ring_1"}},
+		{`front:ringx1`, []string{}},
+		{`"front:ring\_1"`, []string{"ring_1"}},
+		{`front:rin\_1`, []string{}},
+		{"back:of*", []string{"kernel"}},
+		{"text:*subgroup", []string{cloze}},
+		{"is:suspended", []string{"coset"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := search(a, tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"", "empty term"},
+		{"deck:Math (note:Basic", "missing )"},
+		{"deck:Math)", "unexpected"},
+		{"deck:Math OR", "empty term"},
+		{"-", "nothing to negate"},
+		{"kernel", "unsupported search term"},
+		{"is:new", "unsupported search term"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := parseQuery(tt.query)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFindNotesAndCards(t *testing.T) {
+	a := newSearchCollection(t)
+
+	var notes, cards []int
+	query := map[string]any{"query": "deck:Math -is:suspended"}
+	if err := json.Unmarshal(call(t, a, "findNotes", query), &notes); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(call(t, a, "findCards", query), &cards); err != nil {
+		t.Fatal(err)
+	}
+	if len(notes) != 2 || len(cards) != 2 || !sort.IntsAreSorted(notes) || !sort.IntsAreSorted(cards) {
+		t.Fatalf("got notes %v and cards %v, want two of each in ascending order", notes, cards)
+	}
+
+	if _, err := tryCall(a, "findNotes", map[string]any{"query": "deck:Math ("}); err == nil {
+		t.Error("an invalid search is not an error")
+	}
+}
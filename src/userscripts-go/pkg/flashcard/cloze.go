@@ -0,0 +1,57 @@
+package flashcard
+
+import (
+	"fmt"
+	"xk/src/userscripts-go/pkg/treesitter"
+)
+
+// ClozeCard is a card with gaps. Every deletion becomes a card of its own
+// that hides this deletion and shows all others.
+type ClozeCard struct {
+	ID        string
+	Deletions []Deletion
+}
+
+// Deletion holds the sides of the card of one deletion
+type Deletion struct {
+	Front string // the environment with the deletion replaced by \clozeblank
+	Back  string // the environment with the deletion wrapped in \clozeanswer
+}
+
+// EnvToClozeCard extracts a cloze card from the form
+// \begin{clozecard}[<id>] <content with \cloze{...} deletions> \end{clozecard}
+func EnvToClozeCard(env treesitter.GenericEnvironment, source []byte) (ClozeCard, error) {
+	// get id
+	id, ok := EnvID(env, source)
+	if !ok {
+		return ClozeCard{}, fmt.Errorf("clozecard is malformatted")
+	}
+
+	// get deletions, a \cloze nested in another one is part of the outer deletion
+	start := env.EnvironmentNode.StartByte()
+	content := env.EnvironmentNode.Content(source)
+	var deletions []treesitter.GenericCommand
+	for _, cmd := range treesitter.FindGenericCommand(env.EnvironmentNode, source, "cloze") {
+		if len(deletions) > 0 && cmd.CommandNode.StartByte() < deletions[len(deletions)-1].ArgumentNode.EndByte() {
+			continue
+		}
+		deletions = append(deletions, cmd)
+	}
+	if len(deletions) == 0 {
+		return ClozeCard{}, fmt.Errorf("clozecard %s has no \\cloze deletions", id)
+	}
+
+	card := ClozeCard{ID: id}
+	for _, cmd := range deletions {
+		from := cmd.CommandNode.StartByte() - start
+		to := cmd.ArgumentNode.EndByte() - start
+		answer := string(source[cmd.ArgumentNode.StartByte()+1 : cmd.ArgumentNode.EndByte()-1])
+
+		card.Deletions = append(card.Deletions, Deletion{
+			Front: content[:from] + "\\clozeblank{}" + content[to:],
+			Back:  content[:from] + "\\clozeanswer{" + answer + "}" + content[to:],
+		})
+	}
+
+	return card, nil
+}
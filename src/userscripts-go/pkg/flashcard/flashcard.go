@@ -0,0 +1,152 @@
+package flashcard
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// IDPattern describes the ids syncanki is able to pick up from card file names
+var IDPattern = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// Kinds of cards
+const (
+	KindBasic = "basic"
+	KindCloze = "cloze"
+)
+
+// Render modes of cards in Anki
+const (
+	RenderSVG  = "svg"  // images compiled with LaTeX
+	RenderHTML = "html" // HTML with math for Anki's MathJax
+)
+
+// renderComment chooses the render mode of a single card, e.g. "% render: html"
+var renderComment = regexp.MustCompile(`^%\s*render:\s*(svg|html)\s*$`)
+
+// RenderMode returns the render mode a card asks for with a render comment
+// anywhere in its environment, or "" if it leaves the choice to the deck.
+func RenderMode(env treesitter.GenericEnvironment, source []byte) string {
+	var find func(node *sitter.Node) string
+	find = func(node *sitter.Node) string {
+		if node.Type() == "line_comment" {
+			if m := renderComment.FindStringSubmatch(strings.TrimSpace(node.Content(source))); m != nil {
+				return m[1]
+			}
+		}
+		for i := 0; i < int(node.ChildCount()); i++ {
+			if mode := find(node.Child(i)); mode != "" {
+				return mode
+			}
+		}
+		return ""
+	}
+	return find(env.EnvironmentNode)
+}
+
+type FlashCard struct {
+	ID    string
+	Front string
+	Back  string
+}
+
+// EnvToFlashcard extracts flashcards from the form
+// \begin{flashcard}[<id>]{<question>} <content> \end{flashcard}
+func EnvToFlashcard(env treesitter.GenericEnvironment, source []byte) (FlashCard, error) {
+	// get id
+	id, ok := EnvID(env, source)
+	if !ok {
+		return FlashCard{}, fmt.Errorf("flashcard is malformatted")
+	}
+
+	// get front
+	frontNode := env.EnvironmentNode.Child(0).NextSibling()
+	if frontNode == nil || frontNode.Type() != "curly_group" {
+		return FlashCard{}, fmt.Errorf("flashcard is malformatted")
+	}
+	front := string(source[frontNode.StartByte()+1 : frontNode.EndByte()-1])
+
+	// get back
+	back := env.EnvironmentNode.Content(source)
+
+	return FlashCard{id, front, back}, nil
+}
+
+// EnvID returns the [<id>] of a card environment, even if the rest of the
+// card is malformed
+func EnvID(env treesitter.GenericEnvironment, source []byte) (string, bool) {
+	if len(env.ArgumentNodes) == 0 || env.ArgumentNodes[0].Type() != "brack_group" {
+		return "", false
+	}
+	idNode := env.ArgumentNodes[0]
+	return string(source[idNode.StartByte()+1 : idNode.EndByte()-1]), true
+}
+
+// Render wraps the content of a card side into a standalone document with the zettel's preamble
+func Render(preamble, content string) string {
+	return preamble + "\\begin{document}\n" + content + "\n\\end{document}"
+}
+
+// Hash fingerprints the rendered sides of a card. The digest is stored with
+// every note in Anki, so it must stay stable across versions.
+func Hash(front, back []byte) string {
+	digester := crypto.MD5.New()
+	for _, ob := range []any{front, back} {
+		fmt.Fprint(digester, reflect.TypeOf(ob))
+		fmt.Fprint(digester, ob)
+	}
+	return hex.EncodeToString(digester.Sum(nil))
+}
+
+// HashSides fingerprints the rendered sides of a card with one pair of sides
+// per deletion. For a single pair it equals Hash, so basic cards keep their hash.
+func HashSides(fronts, backs [][]byte) string {
+	return Hash(bytes.Join(fronts, []byte(sideSeparator)), bytes.Join(backs, []byte(sideSeparator)))
+}
+
+// sideSeparator joins the sides of the deletions of a cloze card for hashing
+const sideSeparator = "\n%%\n"
+
+// CardFiles names the files gencards writes for one rendered card
+type CardFiles struct {
+	Front string `json:"front"`
+	Back  string `json:"back"`
+}
+
+// Files returns the names of the files gencards writes for a card, relative
+// to the zettel directory. A cloze card has a pair for each deletion.
+func Files(kind, id string, deletions int) []CardFiles {
+	if kind != KindCloze {
+		return []CardFiles{{
+			Front: fmt.Sprintf("card_%s_front.tex", id),
+			Back:  fmt.Sprintf("card_%s_back.tex", id),
+		}}
+	}
+
+	files := make([]CardFiles, deletions)
+	for i := range files {
+		files[i] = CardFiles{
+			Front: fmt.Sprintf("cloze_%s_%d_front.tex", id, i+1),
+			Back:  fmt.Sprintf("cloze_%s_%d_back.tex", id, i+1),
+		}
+	}
+	return files
+}
+
+// HTMLFiles returns the names of the HTML translations of the files of a card
+func HTMLFiles(kind, id string, deletions int) []CardFiles {
+	files := Files(kind, id, deletions)
+	for i := range files {
+		files[i].Front = strings.TrimSuffix(files[i].Front, ".tex") + ".html"
+		files[i].Back = strings.TrimSuffix(files[i].Back, ".tex") + ".html"
+	}
+	return files
+}
@@ -0,0 +1,110 @@
+package flashcard
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ManifestFilename is the name of the manifest gencards writes into every zettel directory
+const ManifestFilename = "cards.json"
+
+// Manifest lists the cards of a zettel and the files generated for them
+type Manifest struct {
+	Cards []ManifestCard `json:"cards"`
+}
+
+// ManifestCard describes one card of a zettel
+type ManifestCard struct {
+	ID    string      `json:"id"`
+	Kind  string      `json:"kind"`  // KindBasic or KindCloze
+	Hash  string      `json:"hash"`  // HashSides of the generated files
+	Start uint32      `json:"start"` // byte offset of the environment in the zettel file
+	End   uint32      `json:"end"`   // byte offset after the environment
+	Files []CardFiles `json:"files"` // relative to the zettel directory, one pair per deletion
+
+	Render string      `json:"render,omitempty"` // RenderSVG or RenderHTML if the card chooses, else the deck does
+	HTML   []CardFiles `json:"html,omitempty"`   // HTML translations of Files, unset if the card has none
+}
+
+// ReadManifest reads the manifest of a zettel directory. A missing manifest
+// yields an error wrapping os.ErrNotExist.
+func ReadManifest(zettelDir string) (Manifest, error) {
+	var manifest Manifest
+	content, err := os.ReadFile(filepath.Join(zettelDir, ManifestFilename))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid %s in %s: %v", ManifestFilename, zettelDir, err)
+	}
+	return manifest, nil
+}
+
+// WriteManifest writes the manifest of a zettel directory if its content changed.
+// It reports whether the file was written.
+func WriteManifest(zettelDir string, manifest Manifest) (bool, error) {
+	if manifest.Cards == nil {
+		manifest.Cards = []ManifestCard{}
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	content = append(content, '\n')
+
+	path := filepath.Join(zettelDir, ManifestFilename)
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+
+	tmp, err := os.CreateTemp(zettelDir, ".cards-*.tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), path)
+}
+
+// Card returns the card with the given id, or nil
+func (m *Manifest) Card(id string) *ManifestCard {
+	for i := range m.Cards {
+		if m.Cards[i].ID == id {
+			return &m.Cards[i]
+		}
+	}
+	return nil
+}
+
+// Files returns the names of all generated files
+func (m *Manifest) Files() []string {
+	var files []string
+	for _, card := range m.Cards {
+		for _, f := range card.Files {
+			files = append(files, f.Front, f.Back)
+		}
+		for _, f := range card.HTML {
+			files = append(files, f.Front, f.Back)
+		}
+	}
+	return files
+}
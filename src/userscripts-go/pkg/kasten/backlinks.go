@@ -0,0 +1,218 @@
+package kasten
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Backlinks returns the zettels referencing the given zettel, as stored in its backlinks file.
+func (k *Kasten) Backlinks(name string) ([]string, error) {
+	return ReadLines(k.File(name, k.BacklinkFilename))
+}
+
+// BuildBacklinks inverts the references files of all zettels.
+// The result maps every zettel to the sorted list of zettels citing it.
+// References to zettels that do not exist are ignored.
+func (k *Kasten) BuildBacklinks() (map[string][]string, error) {
+	zettels, err := k.List()
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string][]string, len(zettels))
+	for _, z := range zettels {
+		index[z] = []string{}
+	}
+
+	for _, z := range zettels {
+		refs, err := k.Refs(z)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read references of %s: %v", z, err)
+		}
+		for _, ref := range unique(refs) {
+			if _, ok := index[ref]; ok {
+				index[ref] = append(index[ref], z)
+			}
+		}
+	}
+
+	for _, links := range index {
+		sort.Strings(links)
+	}
+
+	return index, nil
+}
+
+// WriteBacklinks stores the backlinks of a zettel.
+// The file is only rewritten if its content changes; the returned bool reports whether it did.
+func (k *Kasten) WriteBacklinks(name string, links []string) (bool, error) {
+	links = unique(links)
+	sort.Strings(links)
+
+	path := k.File(name, k.BacklinkFilename)
+	content := ""
+	for _, link := range links {
+		content += link + "\n"
+	}
+
+	existing, err := os.ReadFile(path)
+	if err == nil && string(existing) == content {
+		return false, nil
+	}
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// UpdateBacklinks incrementally applies a change of a zettel's references to the
+// backlinks files of the zettels it used to cite and now cites.
+// It returns the zettels whose backlinks file was rewritten.
+func (k *Kasten) UpdateBacklinks(zettel string, oldRefs, newRefs []string) ([]string, error) {
+	zettel = Normalize(zettel)
+
+	added := difference(newRefs, oldRefs)
+	removed := difference(oldRefs, newRefs)
+
+	var rewritten []string
+	for _, target := range append(added, removed...) {
+		if !k.Exists(target) {
+			continue
+		}
+
+		links, err := k.Backlinks(target)
+		if err != nil {
+			return rewritten, fmt.Errorf("failed to read backlinks of %s: %v", target, err)
+		}
+
+		if contains(added, target) {
+			links = append(links, zettel)
+		} else {
+			links = difference(links, []string{zettel})
+		}
+
+		changed, err := k.WriteBacklinks(target, links)
+		if err != nil {
+			return rewritten, fmt.Errorf("failed to write backlinks of %s: %v", target, err)
+		}
+		if changed {
+			rewritten = append(rewritten, target)
+		}
+	}
+
+	if err := k.recordRefs(zettel, newRefs); err != nil {
+		return rewritten, err
+	}
+	return rewritten, nil
+}
+
+// appliedRefsDir holds, per zettel, the references its backlinks currently reflect
+const appliedRefsDir = "applied-refs"
+
+// AppliedRefs returns the references of a zettel as last applied to the
+// backlinks files by UpdateBacklinks. Without a record, e.g. after a full
+// rebuild, the backlinks files are scanned for them.
+func (k *Kasten) AppliedRefs(zettel string) ([]string, error) {
+	dir, err := k.StateDir(appliedRefsDir)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, Normalize(zettel))
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return k.Citing(zettel)
+	}
+	return ReadLines(path)
+}
+
+// recordRefs remembers the references a zettel's backlinks reflect
+func (k *Kasten) recordRefs(zettel string, refs []string) error {
+	dir, err := k.StateDir(appliedRefsDir)
+	if err != nil {
+		return err
+	}
+	if err := WriteLines(filepath.Join(dir, Normalize(zettel)), unique(refs)); err != nil {
+		return fmt.Errorf("failed to record references of %s: %v", zettel, err)
+	}
+	return nil
+}
+
+// ForgetAppliedRefs drops the recorded references of a zettel, or of all
+// zettels if none is given. It must be called whenever backlinks files are
+// written other than by UpdateBacklinks.
+func (k *Kasten) ForgetAppliedRefs(zettel ...string) error {
+	dir, err := k.StateDir(appliedRefsDir)
+	if err != nil {
+		return err
+	}
+	if len(zettel) == 0 {
+		return os.RemoveAll(dir)
+	}
+	for _, z := range zettel {
+		if err := os.Remove(filepath.Join(dir, Normalize(z))); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Citing scans all backlinks files and returns the zettels that currently
+// list the given zettel as a backlink, i.e. the references recorded for it.
+func (k *Kasten) Citing(zettel string) ([]string, error) {
+	zettels, err := k.List()
+	if err != nil {
+		return nil, err
+	}
+
+	zettel = Normalize(zettel)
+	var targets []string
+	for _, z := range zettels {
+		links, err := k.Backlinks(z)
+		if err != nil {
+			return nil, err
+		}
+		if contains(links, zettel) {
+			targets = append(targets, z)
+		}
+	}
+	return targets, nil
+}
+
+// unique removes duplicate entries while keeping the first occurrence.
+func unique(list []string) []string {
+	seen := make(map[string]bool, len(list))
+	result := []string{}
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		result = append(result, s)
+	}
+	return result
+}
+
+// difference returns the entries of a that are not in b.
+func difference(a, b []string) []string {
+	result := []string{}
+	for _, s := range unique(a) {
+		if !contains(b, s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
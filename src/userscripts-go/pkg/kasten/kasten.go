@@ -0,0 +1,311 @@
+package kasten
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kasten describes a zettelkasten on disk, mirroring the layout
+// configured for the bash xk entrypoint.
+type Kasten struct {
+	Root              string // ZETTEL_DATA
+	ZettelFilename    string // ZETTEL_FILENAME
+	ReferenceFilename string // REFERENCE_FILENAME
+	TagFilename       string // TAG_FILENAME
+	BacklinkFilename  string // BACKLINK_FILENAME
+	Template          string // ZETTEL_TEMPLATE
+}
+
+// FromEnv builds a Kasten from the environment that xk exports to its userscripts.
+func FromEnv() (*Kasten, error) {
+	root, set := os.LookupEnv("ZETTEL_DATA")
+	if !set || root == "" {
+		return nil, errors.New("ZETTEL_DATA is not set")
+	}
+
+	k := &Kasten{
+		Root:              root,
+		ZettelFilename:    envOr("ZETTEL_FILENAME", "zettel.tex"),
+		ReferenceFilename: envOr("REFERENCE_FILENAME", "references"),
+		TagFilename:       envOr("TAG_FILENAME", "tags"),
+		BacklinkFilename:  envOr("BACKLINK_FILENAME", "backlinks"),
+		Template:          os.Getenv("ZETTEL_TEMPLATE"),
+	}
+
+	if info, err := os.Stat(k.Root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("%s does not exist. Please run init", k.Root)
+	}
+
+	return k, nil
+}
+
+// envOr returns the value of an environment variable or a fallback if it is unset.
+func envOr(key, fallback string) string {
+	if value, set := os.LookupEnv(key); set && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Normalize converts a zettel name the way the bash scripts do (spaces become underscores).
+func Normalize(name string) string {
+	return strings.ReplaceAll(name, " ", "_")
+}
+
+// Dir returns the directory of a zettel without checking that it exists.
+func (k *Kasten) Dir(name string) string {
+	return filepath.Join(k.Root, Normalize(name))
+}
+
+// File returns the path of a file inside a zettel directory, e.g. k.File(z, k.TagFilename).
+func (k *Kasten) File(name, filename string) string {
+	return filepath.Join(k.Dir(name), filename)
+}
+
+// StateDir returns (and creates) a directory below ZETTEL_DATA/.xk for
+// indexes and caches generated by the userscripts.
+func (k *Kasten) StateDir(elem ...string) (string, error) {
+	dir := filepath.Join(append([]string{k.Root, ".xk"}, elem...)...)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	return dir, nil
+}
+
+// List returns the names of all zettels, sorted alphabetically.
+func (k *Kasten) List() ([]string, error) {
+	entries, err := os.ReadDir(k.Root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zettels: %v", err)
+	}
+
+	var zettels []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if k.Exists(entry.Name()) {
+			zettels = append(zettels, entry.Name())
+		}
+	}
+	sort.Strings(zettels)
+
+	return zettels, nil
+}
+
+// Exists reports whether the zettel directory holds a zettel file.
+func (k *Kasten) Exists(name string) bool {
+	if name == "" {
+		return false
+	}
+	info, err := os.Stat(k.File(name, k.ZettelFilename))
+	return err == nil && info.Mode().IsRegular()
+}
+
+// Path returns the directory of an existing zettel.
+func (k *Kasten) Path(name string) (string, error) {
+	if !k.Exists(name) {
+		return "", fmt.Errorf("zettel does not exist: %s", name)
+	}
+	return k.Dir(name), nil
+}
+
+// Insert creates a new zettel from the configured template and returns its directory.
+func (k *Kasten) Insert(name string) (string, error) {
+	name = Normalize(name)
+	if name == "" {
+		return "", errors.New("zettel name cannot be empty")
+	}
+
+	dir := k.Dir(name)
+	if _, err := os.Stat(dir); err == nil {
+		return "", fmt.Errorf("%s already exists", name)
+	}
+
+	content, err := k.expandTemplate(name)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create zettel directory %s: %v", name, err)
+	}
+	if err := os.WriteFile(k.File(name, k.ZettelFilename), content, 0644); err != nil {
+		return "", fmt.Errorf("failed to create zettel file %s: %v", name, err)
+	}
+	for _, filename := range []string{k.ReferenceFilename, k.TagFilename} {
+		if err := os.WriteFile(k.File(name, filename), nil, 0644); err != nil {
+			return "", fmt.Errorf("failed to create %s of %s: %v", filename, name, err)
+		}
+	}
+
+	return dir, nil
+}
+
+// expandTemplate substitutes variables in the zettel template like envsubst does.
+func (k *Kasten) expandTemplate(name string) ([]byte, error) {
+	if k.Template == "" {
+		return nil, nil
+	}
+
+	template, err := os.ReadFile(k.Template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template: %v", err)
+	}
+
+	expanded := os.Expand(string(template), func(key string) string {
+		switch {
+		case key == "NAME":
+			return strings.ReplaceAll(name, "_", " ")
+		case key == "PREAMBLE":
+			return os.Getenv("PREAMBLE_FILE")
+		case !isIdentifier(key):
+			// envsubst leaves anything that is not a variable untouched
+			return "$" + key
+		}
+		return os.Getenv(key)
+	})
+
+	return []byte(expanded), nil
+}
+
+// isIdentifier reports whether s is a valid shell variable name.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if !letter && (i == 0 || r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Remove deletes a zettel directory with all its contents.
+func (k *Kasten) Remove(name string) error {
+	if _, err := k.Path(name); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(k.Dir(name)); err != nil {
+		return fmt.Errorf("error removing zettel %s: %v", name, err)
+	}
+	return nil
+}
+
+// Move renames a zettel and rewrites every reference and backlink to it.
+func (k *Kasten) Move(oldName, newName string) error {
+	oldName, newName = Normalize(oldName), Normalize(newName)
+	if _, err := k.Path(oldName); err != nil {
+		return err
+	}
+	if newName == "" {
+		return errors.New("zettel name cannot be empty")
+	}
+	if _, err := os.Stat(k.Dir(newName)); err == nil {
+		return fmt.Errorf("%s already exists", newName)
+	}
+
+	if err := os.Rename(k.Dir(oldName), k.Dir(newName)); err != nil {
+		return fmt.Errorf("failed to move zettel from %s to %s: %v", oldName, newName, err)
+	}
+
+	zettels, err := k.List()
+	if err != nil {
+		return err
+	}
+	for _, z := range zettels {
+		refs, err := k.Refs(z)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for i, ref := range refs {
+			if ref == oldName {
+				refs[i] = newName
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if err := WriteLines(k.File(z, k.ReferenceFilename), refs); err != nil {
+			return fmt.Errorf("failed to update reference for %s: %v", z, err)
+		}
+	}
+
+	// keep the backlinks of the zettels cited by the moved zettel in sync
+	refs, err := k.Refs(newName)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		if !k.Exists(ref) {
+			continue
+		}
+		links, err := k.Backlinks(ref)
+		if err != nil {
+			return err
+		}
+		if !contains(links, oldName) {
+			continue
+		}
+		links = append(difference(links, []string{oldName}), newName)
+		if _, err := k.WriteBacklinks(ref, links); err != nil {
+			return fmt.Errorf("failed to update backlinks of %s: %v", ref, err)
+		}
+	}
+
+	// the backlinks now list the new name, they are scanned for it next time
+	return k.ForgetAppliedRefs(oldName, newName)
+}
+
+// Refs returns the references stored for a zettel.
+func (k *Kasten) Refs(name string) ([]string, error) {
+	return ReadLines(k.File(name, k.ReferenceFilename))
+}
+
+// Tags returns the tags stored for a zettel.
+func (k *Kasten) Tags(name string) ([]string, error) {
+	return ReadLines(k.File(name, k.TagFilename))
+}
+
+// ReadLines reads a newline separated list, skipping empty lines.
+// A missing file is treated as an empty list.
+func ReadLines(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseLines(content), nil
+}
+
+// ParseLines splits the content of a list file like ReadLines does.
+func ParseLines(content []byte) []string {
+	lines := []string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// WriteLines writes a newline separated list, one entry per line.
+func WriteLines(path string, lines []string) error {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
@@ -56,3 +56,20 @@ func PanicWithLog(msg string, args ...interface{}) {
 	log.Printf(msg, args...)
 	panic(fmt.Sprintf(msg, args...))
 }
+
+// NewFileLogger opens the log file, truncates it to the last LogMaxLines lines
+// and returns a logger appending to it. Unlike SetLogOutput it leaves the
+// standard logger untouched, so several log files can be written concurrently.
+func NewFileLogger(logFilePath string) (*log.Logger, *os.File, error) {
+	logFile, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening log file: %v", err)
+	}
+
+	if err := TruncateLogFile(logFilePath, LogMaxLines); err != nil {
+		logFile.Close()
+		return nil, nil, err
+	}
+
+	return log.New(logFile, "", log.LstdFlags), logFile, nil
+}
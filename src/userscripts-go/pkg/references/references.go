@@ -0,0 +1,237 @@
+package references
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// Extractor finds the zettels referenced in a parsed zettel.
+type Extractor struct {
+	Query    *sitter.Query // captures citation keys, configured in TS_QUERY_REF
+	Commands []string      // additional macros whose argument names zettels, configured in REF_COMMANDS
+}
+
+// NewExtractor compiles the query configured in TS_QUERY_REF and reads the
+// user defined link macros from REF_COMMANDS (separated by spaces or commas).
+func NewExtractor(lang *sitter.Language) (*Extractor, error) {
+	refQuery, set := os.LookupEnv("TS_QUERY_REF")
+	if !set || refQuery == "" {
+		return nil, errors.New("treesitter query for references not configured")
+	}
+
+	query, err := sitter.NewQuery([]byte(refQuery), lang)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := strings.FieldsFunc(os.Getenv("REF_COMMANDS"), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for i, command := range commands {
+		commands[i] = strings.TrimPrefix(command, "\\")
+	}
+
+	return &Extractor{Query: query, Commands: commands}, nil
+}
+
+// Close releases the compiled query.
+func (e *Extractor) Close() {
+	e.Query.Close()
+}
+
+// occurrence is a single key inside a citation or link macro
+type occurrence struct {
+	start   uint32 // byte range of the key
+	end     uint32
+	command *sitter.Node // the citing command, e.g. \cite or \citet*
+}
+
+// Extract returns the referenced zettel names in order of first occurrence.
+// The names are not validated against the kasten.
+func (e *Extractor) Extract(root *sitter.Node, source []byte) []string {
+	return Targets(e.Occurrences(root, source))
+}
+
+// Occurrences returns every reference with its position, in order of appearance.
+func (e *Extractor) Occurrences(root *sitter.Node, source []byte) []Occurrence {
+	lines := lineStarts(source)
+
+	var result []Occurrence
+	for _, o := range e.occurrences(root, source) {
+		line := sort.Search(len(lines), func(i int) bool { return lines[i] > o.start }) - 1
+
+		command := ""
+		if o.command != nil {
+			command = o.command.Content(source)
+		}
+
+		result = append(result, Occurrence{
+			Target:    string(source[o.start:o.end]),
+			StartByte: o.start,
+			EndByte:   o.end,
+			Line:      line + 1,
+			Column:    int(o.start-lines[line]) + 1,
+			Command:   command,
+			Context:   snippet(root, source, o.start, o.end),
+		})
+	}
+	return result
+}
+
+// Targets returns the distinct targets of the occurrences in order of first appearance.
+func Targets(occurrences []Occurrence) []string {
+	seen := map[string]bool{}
+	var refs []string
+	for _, o := range occurrences {
+		if seen[o.Target] {
+			continue
+		}
+		seen[o.Target] = true
+		refs = append(refs, o.Target)
+	}
+	return refs
+}
+
+// occurrences collects every referenced key with its position, sorted by position
+func (e *Extractor) occurrences(root *sitter.Node, source []byte) []occurrence {
+	var found []occurrence
+	seen := map[uint32]bool{}
+	add := func(group, command *sitter.Node) {
+		for _, o := range splitKeys(group, source) {
+			if seen[o.start] {
+				continue
+			}
+			seen[o.start] = true
+			o.command = command
+			found = append(found, o)
+		}
+	}
+
+	cursor := sitter.NewQueryCursor()
+	defer cursor.Close()
+	cursor.Exec(e.Query, root)
+
+	for {
+		m, ok := cursor.NextMatch()
+		if !ok {
+			break
+		}
+		// Apply predicates filtering
+		m = cursor.FilterPredicates(m, source)
+		for _, c := range m.Captures {
+			node := c.Node
+			command := citingCommand(node)
+
+			switch {
+			case node.Type() == "citation":
+				// the whole citation was captured, only its keys are references
+				if keys := node.ChildByFieldName("keys"); keys != nil {
+					add(keys, command)
+				}
+			case node.Type() == "brack_group" && command != nil:
+				// pre- and postnotes like \cite[p.~3]{foo} are not references
+				continue
+			default:
+				add(node, command)
+			}
+		}
+	}
+
+	for _, name := range e.Commands {
+		for _, variant := range []string{name, name + "*"} {
+			for _, c := range treesitter.FindGenericCommand(root, source, variant) {
+				add(c.ArgumentNode, c.CommandNode)
+			}
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].start < found[j].start })
+	return found
+}
+
+// citingCommand returns the command node of the citation containing node, if any
+func citingCommand(node *sitter.Node) *sitter.Node {
+	for n := node; n != nil; n = n.Parent() {
+		switch n.Type() {
+		case "citation":
+			return n.ChildByFieldName("command")
+		case "generic_command":
+			return n.Child(0)
+		}
+	}
+	return nil
+}
+
+// splitKeys splits a captured group like {foo, bar} into the byte ranges of its
+// comma separated keys, skipping surrounding brackets, whitespace and comments.
+func splitKeys(node *sitter.Node, source []byte) []occurrence {
+	return splitRange(source, node.StartByte(), node.EndByte())
+}
+
+func splitRange(source []byte, start, end uint32) []occurrence {
+	if end-start >= 2 {
+		first, last := source[start], source[end-1]
+		if (first == '{' && last == '}') || (first == '[' && last == ']') {
+			start, end = start+1, end-1
+		}
+	}
+
+	var keys []occurrence
+	segment := start
+	for i := start; i <= end; i++ {
+		if i < end && source[i] == '%' {
+			// skip line comments, commas inside them do not separate keys
+			for i+1 < end && source[i+1] != '\n' {
+				i++
+			}
+			continue
+		}
+		if i < end && source[i] != ',' {
+			continue
+		}
+		if key, ok := trimKey(source, segment, i); ok {
+			keys = append(keys, key)
+		}
+		segment = i + 1
+	}
+
+	return keys
+}
+
+// trimKey strips whitespace and comments from both ends of a key
+func trimKey(source []byte, start, end uint32) (occurrence, bool) {
+	for start < end {
+		if isSpace(source[start]) {
+			start++
+		} else if source[start] == '%' {
+			for start < end && source[start] != '\n' {
+				start++
+			}
+		} else {
+			break
+		}
+	}
+
+	// cut off a trailing comment
+	for i := start; i < end; i++ {
+		if source[i] == '%' {
+			end = i
+			break
+		}
+	}
+
+	for end > start && isSpace(source[end-1]) {
+		end--
+	}
+
+	return occurrence{start: start, end: end}, end > start
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
@@ -0,0 +1,98 @@
+package references
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// SnippetRadius is the number of bytes of context kept on each side of a reference
+const SnippetRadius = 60
+
+// Occurrence is a single reference to a zettel inside a zettel file
+type Occurrence struct {
+	Target    string `json:"-"`
+	StartByte uint32 `json:"start_byte"`
+	EndByte   uint32 `json:"end_byte"`
+	Line      int    `json:"line"`   // 1-based
+	Column    int    `json:"column"` // 1-based, in bytes
+	Command   string `json:"command"`
+	Context   string `json:"context"`
+}
+
+// Target collects all occurrences of one referenced zettel
+type Target struct {
+	Target      string       `json:"target"`
+	Occurrences []Occurrence `json:"occurrences"`
+}
+
+// Sidecar is the content of the references.json file written next to the plain references file
+type Sidecar struct {
+	Zettel     string   `json:"zettel"`
+	References []Target `json:"references"`
+}
+
+// NewSidecar groups occurrences by target. Targets rejected by valid are left
+// out, so the sidecar lists the same zettels as the plain references file.
+func NewSidecar(zettel string, occurrences []Occurrence, valid func(string) bool) Sidecar {
+	byTarget := map[string][]Occurrence{}
+	for _, o := range occurrences {
+		if valid(o.Target) {
+			byTarget[o.Target] = append(byTarget[o.Target], o)
+		}
+	}
+
+	sidecar := Sidecar{Zettel: zettel, References: []Target{}}
+	for target, occs := range byTarget {
+		sidecar.References = append(sidecar.References, Target{target, occs})
+	}
+	sort.Slice(sidecar.References, func(i, j int) bool {
+		return sidecar.References[i].Target < sidecar.References[j].Target
+	})
+
+	return sidecar
+}
+
+// Marshal encodes the sidecar as indented JSON with a trailing newline
+func (s Sidecar) Marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// lineStarts returns the byte offset of the start of every line
+func lineStarts(source []byte) []uint32 {
+	starts := []uint32{0}
+	for i, b := range source {
+		if b == '\n' {
+			starts = append(starts, uint32(i+1))
+		}
+	}
+	return starts
+}
+
+// snippet returns the plain text around a reference on a single line. Markup,
+// math, comments and citations are dropped, see treesitter.PlainTextRange.
+func snippet(root *sitter.Node, source []byte, start, end uint32) string {
+	from := uint32(0)
+	if start > SnippetRadius {
+		from = start - SnippetRadius
+	}
+	to := min(end+SnippetRadius, uint32(len(source)))
+
+	// stay within the paragraph of the reference
+	if i := strings.LastIndex(string(source[from:start]), "\n\n"); i >= 0 {
+		from += uint32(i) + 2
+	}
+	if i := strings.Index(string(source[end:to]), "\n\n"); i >= 0 {
+		to = end + uint32(i)
+	}
+
+	text := treesitter.PlainTextRange(root, source, from, to, treesitter.PlainTextOptions{})
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,157 @@
+package rendercache
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"xk/src/userscripts-go/pkg/kasten"
+)
+
+// Rendered holds the SVGs of a card, one front and back per deletion
+type Rendered struct {
+	Fronts [][]byte
+	Backs  [][]byte
+}
+
+// Cache stores rendered cards in ZETTEL_DATA/.xk/render-cache, keyed by the
+// card hash and the hash of the class and style files of the kasten. Files
+// are only ever added or removed whole, so the cache is safe for concurrent use.
+type Cache struct {
+	dir   string
+	style string
+}
+
+// Open opens the render cache of a kasten
+func Open(k *kasten.Kasten) (*Cache, error) {
+	dir, err := k.StateDir("render-cache")
+	if err != nil {
+		return nil, err
+	}
+	style, err := StyleHash(k.Root)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, style: style}, nil
+}
+
+// StyleHash fingerprints the .cls and .sty files in the root of the kasten,
+// which the card files load but which are not part of the card hash.
+func StyleHash(root string) (string, error) {
+	var files []string
+	for _, pattern := range []string{"*.cls", "*.sty"} {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return "", err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	digest := sha256.New()
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		fmt.Fprintf(digest, "%s\x00%d\x00", filepath.Base(file), len(content))
+		digest.Write(content)
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// path returns the cache file of a card hash
+func (c *Cache) path(cardHash string) string {
+	sum := sha256.Sum256([]byte(cardHash + "\x00" + c.style))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".gob")
+}
+
+// Get returns the cached rendering of a card. A hit marks the entry as recently used.
+func (c *Cache) Get(cardHash string) (Rendered, bool) {
+	path := c.path(cardHash)
+	f, err := os.Open(path)
+	if err != nil {
+		return Rendered{}, false
+	}
+	defer f.Close()
+
+	var rendered Rendered
+	if err := gob.NewDecoder(f).Decode(&rendered); err != nil {
+		return Rendered{}, false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return rendered, true
+}
+
+// Put stores the rendering of a card atomically
+func (c *Cache) Put(cardHash string, rendered Rendered) error {
+	tmp, err := os.CreateTemp(c.dir, ".render-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(rendered); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path(cardHash))
+}
+
+// GC removes the least recently used entries until the cache holds at most
+// limit bytes. It returns the number of removed entries.
+func (c *Cache) GC(limit int64) (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	type file struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []file
+	var total int64
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".gob") {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		files = append(files, file{filepath.Join(c.dir, entry.Name()), info.Size(), info.ModTime()})
+		total += info.Size()
+	}
+
+	// oldest first
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+
+	removed := 0
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		total -= f.size
+		removed++
+	}
+	return removed, nil
+}
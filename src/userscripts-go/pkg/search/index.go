@@ -0,0 +1,225 @@
+package search
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"xk/src/userscripts-go/pkg/kasten"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// indexVersion is bumped whenever tokenization or the file format changes
+const indexVersion = 1
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// Document holds what the index knows about a single zettel
+type Document struct {
+	ModTime int64  // modification time of the zettel file (unix nanoseconds)
+	Size    int64  // size of the zettel file
+	Hash    string // sha256 of the zettel file
+	Length  int    // number of indexed terms
+	Terms   []string
+}
+
+// Index is a persistent inverted index over all zettel files
+type Index struct {
+	Version  int
+	Docs     map[string]*Document
+	Postings map[string]map[string]int // term -> zettel -> term frequency
+	Total    int                       // sum of all document lengths
+}
+
+// Result is a ranked search hit
+type Result struct {
+	Zettel string
+	Score  float64
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		Version:  indexVersion,
+		Docs:     map[string]*Document{},
+		Postings: map[string]map[string]int{},
+	}
+}
+
+// Load reads an index from disk. A missing or outdated index yields an empty one.
+func Load(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewIndex(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var index Index
+	if err := gob.NewDecoder(file).Decode(&index); err != nil || index.Version != indexVersion {
+		return NewIndex(), nil
+	}
+	return &index, nil
+}
+
+// Save writes the index atomically.
+func (idx *Index) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".search-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(idx); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Update brings the index in line with the kasten. Zettels are only reparsed
+// if their modification time or size changed and their content hash differs.
+// It returns the number of reindexed zettels.
+func (idx *Index) Update(k *kasten.Kasten, parser *sitter.Parser) (int, error) {
+	zettels, err := k.List()
+	if err != nil {
+		return 0, err
+	}
+
+	present := map[string]bool{}
+	updated := 0
+	for _, z := range zettels {
+		present[z] = true
+		path := k.File(z, k.ZettelFilename)
+
+		info, err := os.Stat(path)
+		if err != nil {
+			return updated, err
+		}
+
+		doc, ok := idx.Docs[z]
+		if ok && doc.ModTime == info.ModTime().UnixNano() && doc.Size == info.Size() {
+			continue
+		}
+
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return updated, err
+		}
+		sum := sha256.Sum256(source)
+		hash := hex.EncodeToString(sum[:])
+
+		if ok && doc.Hash == hash {
+			doc.ModTime, doc.Size = info.ModTime().UnixNano(), info.Size()
+			continue
+		}
+
+		tree := parser.Parse(nil, source)
+		tokens := Tokenize(tree.RootNode(), source)
+		tree.Close()
+
+		idx.remove(z)
+		idx.add(z, tokens, &Document{
+			ModTime: info.ModTime().UnixNano(),
+			Size:    info.Size(),
+			Hash:    hash,
+		})
+		updated++
+	}
+
+	for z := range idx.Docs {
+		if !present[z] {
+			idx.remove(z)
+			updated++
+		}
+	}
+
+	return updated, nil
+}
+
+// add indexes the tokens of a zettel
+func (idx *Index) add(zettel string, tokens []Token, doc *Document) {
+	frequencies := map[string]int{}
+	for _, t := range tokens {
+		frequencies[t.Term]++
+	}
+
+	for term, tf := range frequencies {
+		if idx.Postings[term] == nil {
+			idx.Postings[term] = map[string]int{}
+		}
+		idx.Postings[term][zettel] = tf
+		doc.Terms = append(doc.Terms, term)
+	}
+
+	doc.Length = len(tokens)
+	idx.Docs[zettel] = doc
+	idx.Total += doc.Length
+}
+
+// remove drops a zettel from the index
+func (idx *Index) remove(zettel string) {
+	doc, ok := idx.Docs[zettel]
+	if !ok {
+		return
+	}
+
+	for _, term := range doc.Terms {
+		delete(idx.Postings[term], zettel)
+		if len(idx.Postings[term]) == 0 {
+			delete(idx.Postings, term)
+		}
+	}
+
+	idx.Total -= doc.Length
+	delete(idx.Docs, zettel)
+}
+
+// Search ranks the zettels matching any of the terms with BM25.
+func (idx *Index) Search(terms []string) []Result {
+	n := float64(len(idx.Docs))
+	if n == 0 {
+		return nil
+	}
+	avgLength := float64(idx.Total) / n
+
+	scores := map[string]float64{}
+	for _, term := range terms {
+		postings := idx.Postings[term]
+		df := float64(len(postings))
+		idf := math.Log((n-df+0.5)/(df+0.5) + 1)
+
+		for zettel, tf := range postings {
+			length := float64(idx.Docs[zettel].Length)
+			f := float64(tf)
+			scores[zettel] += idf * f * (k1 + 1) / (f + k1*(1-b+b*length/avgLength))
+		}
+	}
+
+	results := make([]Result, 0, len(scores))
+	for zettel, score := range scores {
+		results = append(results, Result{zettel, score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Zettel < results[j].Zettel
+	})
+
+	return results
+}
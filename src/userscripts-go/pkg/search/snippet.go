@@ -0,0 +1,45 @@
+package search
+
+// SnippetWords is the number of words shown on each side of the first match
+const SnippetWords = 8
+
+// Snippet returns the words around the first token matching one of the terms.
+// Matching words are wrapped in the given highlight markers.
+func Snippet(tokens []Token, source []byte, terms []string, pre, post string) string {
+	wanted := map[string]bool{}
+	for _, t := range terms {
+		wanted[t] = true
+	}
+
+	first := 0
+	for i, t := range tokens {
+		if wanted[t.Term] {
+			first = i
+			break
+		}
+	}
+
+	from := max(first-SnippetWords, 0)
+	to := min(first+SnippetWords+1, len(tokens))
+
+	snippet := ""
+	if from > 0 {
+		snippet = "… "
+	}
+	for i := from; i < to; i++ {
+		t := tokens[i]
+		word := string(source[t.Start:t.End])
+		if wanted[t.Term] {
+			word = pre + word + post
+		}
+		if i > from {
+			snippet += " "
+		}
+		snippet += word
+	}
+	if to < len(tokens) {
+		snippet += " …"
+	}
+
+	return snippet
+}
@@ -0,0 +1,97 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+	"xk/src/userscripts-go/pkg/treesitter"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// Token is an indexed term together with the byte range of the word it came from
+type Token struct {
+	Term  string
+	Start uint32
+	End   uint32
+}
+
+// skippedNodes are never indexed: command and environment names, comments and identifiers
+var skippedNodes = map[string]bool{
+	"command_name":        true,
+	"line_comment":        true,
+	"block_comment":       true,
+	"comment_environment": true,
+	"label_definition":    true,
+	"label_reference":     true,
+}
+
+// Tokenize returns the terms of the document body of a parsed zettel.
+// Text and math arguments are indexed, while the preamble, command names,
+// environment names and comments are skipped.
+func Tokenize(root *sitter.Node, source []byte) []Token {
+	body := treesitter.FindDocument(root, source)
+	if body == nil {
+		body = root
+	}
+
+	var tokens []Token
+	var walk func(node *sitter.Node)
+	walk = func(node *sitter.Node) {
+		if skippedNodes[node.Type()] {
+			return
+		}
+		if node.Type() == "word" {
+			tokens = append(tokens, splitWord(node.Content(source), node.StartByte())...)
+			return
+		}
+		environment := node.Type() == "begin" || node.Type() == "end"
+		for i := 0; i < int(node.ChildCount()); i++ {
+			// keep the options of \begin, but not the environment name
+			if environment && node.FieldNameForChild(i) == "name" {
+				continue
+			}
+			walk(node.Child(i))
+		}
+	}
+	walk(body)
+
+	return tokens
+}
+
+// Terms splits a search query the same way the index is built.
+func Terms(query string) []string {
+	var terms []string
+	for _, t := range splitWord(query, 0) {
+		terms = append(terms, t.Term)
+	}
+	return terms
+}
+
+// splitWord breaks a word node into lower case terms of letters and digits
+func splitWord(word string, offset uint32) []Token {
+	var tokens []Token
+	start := -1
+	flush := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, Token{
+				Term:  strings.ToLower(word[start:end]),
+				Start: offset + uint32(start),
+				End:   offset + uint32(end),
+			})
+			start = -1
+		}
+	}
+
+	for i, r := range word {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+		} else {
+			flush(i)
+		}
+	}
+	flush(len(word))
+
+	return tokens
+}
@@ -0,0 +1,594 @@
+package treesitter
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// ErrUntranslatable is wrapped by the errors of HTML for constructs without a translation
+var ErrUntranslatable = errors.New("no HTML translation")
+
+// HTMLOptions configures HTML
+type HTMLOptions struct {
+	Macros map[string]Macro // commands defined in the zettel that may be used in math
+}
+
+// Macro is a command definition that MathJax can understand
+type Macro struct {
+	Definition string   // e.g. \newcommand{\R}{\mathbb{R}}
+	Uses       []string // the commands used by the definition
+}
+
+// htmlDroppedNodes are left out of the HTML together with their arguments
+var htmlDroppedNodes = map[string]bool{
+	"line_comment":                true,
+	"block_comment":               true,
+	"comment_environment":         true,
+	"label_definition":            true,
+	"package_include":             true,
+	"new_command_definition":      true,
+	"old_command_definition":      true,
+	"let_command_definition":      true,
+	"paired_delimiter_definition": true,
+	"environment_definition":      true,
+	"theorem_definition":          true,
+	"color_definition":            true,
+	"color_set_definition":        true,
+}
+
+// htmlTags are the text commands with an HTML equivalent, "" keeps only the argument
+var htmlTags = map[string]string{
+	"\\textbf": "b", "\\textit": "i", "\\emph": "i", "\\textsl": "i",
+	"\\underline": "u", "\\texttt": "code", "\\textsuperscript": "sup",
+	"\\textsubscript": "sub", "\\textrm": "", "\\textsf": "", "\\textnormal": "",
+	"\\textup": "", "\\text": "", "\\mbox": "",
+	// the commands of the clozecard environment, see preamble.sty
+	"\\cloze": "", "\\clozeanswer": "u",
+}
+
+// htmlSymbols are commands without arguments that stand for some text
+var htmlSymbols = map[string]string{
+	"\\ldots": "…", "\\dots": "…", "\\textellipsis": "…", "\\LaTeX": "LaTeX",
+	"\\TeX": "TeX", "\\textbackslash": "\\", "\\S": "§", "\\P": "¶",
+	"\\quad": "&emsp;", "\\qquad": "&emsp;&emsp;", "\\,": "&thinsp;",
+	"\\ ": " ", "\\;": " ", "\\:": " ", "\\!": "", "\\clozeblank": "[…]",
+}
+
+// quotes replaces the TeX quotation marks
+var quotes = strings.NewReplacer("``", "“", "''", "”")
+
+// htmlEnvironments are the text environments with an HTML equivalent
+var htmlEnvironments = map[string]string{
+	"itemize":     "ul",
+	"enumerate":   "ol",
+	"description": "ul",
+	"quote":       "blockquote",
+	"quotation":   "blockquote",
+	"center":      `div style="text-align: center"`,
+}
+
+// displayMath translates the top level math environments to the MathJax
+// environment used inside \[ \], "" means the content needs none
+var displayMath = map[string]string{
+	"displaymath": "", "displaymath*": "", "equation": "", "equation*": "",
+	"align": "aligned", "align*": "aligned", "gather": "gathered", "gather*": "gathered",
+}
+
+// mathEnvironments may be used inside math
+var mathEnvironments = setOf(`matrix pmatrix bmatrix Bmatrix vmatrix Vmatrix smallmatrix
+	cases aligned alignedat gathered split array subarray`)
+
+// mathCommands are the commands MathJax knows. Math with any other command
+// that the zettel does not define is not translated.
+var mathCommands = setOf(`
+	\alpha \beta \gamma \delta \epsilon \varepsilon \zeta \eta \theta \vartheta \iota
+	\kappa \varkappa \lambda \mu \nu \xi \pi \varpi \rho \varrho \sigma \varsigma \tau
+	\upsilon \phi \varphi \chi \psi \omega \Gamma \Delta \Theta \Lambda \Xi \Pi \Sigma
+	\Upsilon \Phi \Psi \Omega \digamma \aleph \beth \gimel \daleth
+
+	\pm \mp \times \div \cdot \ast \star \circ \bullet \oplus \ominus \otimes \oslash
+	\odot \cap \cup \sqcap \sqcup \vee \wedge \land \lor \wr \setminus \smallsetminus
+	\amalg \dagger \ddagger \triangleleft \triangleright \bigcirc \uplus \lhd \rhd
+
+	\le \leq \ge \geq \neq \ne \equiv \sim \simeq \approx \approxeq \cong \propto \prec
+	\succ \preceq \succeq \ll \gg \subset \supset \subseteq \supseteq \subsetneq
+	\supsetneq \sqsubseteq \sqsupseteq \in \ni \notin \mid \nmid \parallel \nparallel
+	\perp \models \vdash \dashv \vDash \Vdash \asymp \doteq \bowtie \lesssim \gtrsim
+	\leqslant \geqslant \lneq \gneq \nleq \ngeq \nsubseteq \nsupseteq \coloneqq
+	\eqqcolon \triangleq
+
+	\to \gets \leftarrow \rightarrow \Leftarrow \Rightarrow \leftrightarrow
+	\Leftrightarrow \longleftarrow \longrightarrow \Longleftarrow \Longrightarrow
+	\longleftrightarrow \Longleftrightarrow \mapsto \longmapsto \hookrightarrow
+	\hookleftarrow \uparrow \downarrow \Uparrow \Downarrow \updownarrow \nearrow
+	\searrow \swarrow \nwarrow \iff \implies \impliedby \rightharpoonup \leftharpoonup
+	\rightleftharpoons \twoheadrightarrow \rightarrowtail \leadsto \xrightarrow
+	\xleftarrow
+
+	\infty \partial \nabla \forall \exists \nexists \neg \lnot \emptyset \varnothing
+	\ell \hbar \Re \Im \wp \angle \triangle \square \blacksquare \Box \Diamond \top
+	\bot \prime \backslash \flat \natural \sharp \clubsuit \diamondsuit \heartsuit
+	\spadesuit \dots \ldots \cdots \vdots \ddots \colon \checkmark \imath \jmath
+	\cdotp \ldotp
+
+	\sum \prod \coprod \int \iint \iiint \oint \bigcup \bigcap \bigoplus \bigotimes
+	\bigodot \bigvee \bigwedge \bigsqcup \biguplus \lim \limsup \liminf \sup \inf \max
+	\min \det \dim \ker \hom \deg \arg \exp \log \ln \lg \sin \cos \tan \cot \sec \csc
+	\arcsin \arccos \arctan \sinh \cosh \tanh \coth \gcd \Pr \limits \nolimits
+
+	\langle \rangle \lfloor \rfloor \lceil \rceil \lvert \rvert \lVert \rVert \vert
+	\Vert \lbrace \rbrace \left \right \middle \big \Big \bigg \Bigg \bigl \bigr \Bigl
+	\Bigr \biggl \biggr \Biggl \Biggr
+
+	\frac \dfrac \tfrac \cfrac \binom \dbinom \tbinom \sqrt \overline \underline
+	\widehat \widetilde \overbrace \underbrace \overrightarrow \overleftarrow \stackrel
+	\overset \underset \substack \choose \atop \not \boxed \cancel \pmod \bmod \mod
+	\tag \intertext \shortintertext
+
+	\hat \check \tilde \acute \grave \dot \ddot \breve \bar \vec \mathring
+
+	\mathbb \mathbf \mathcal \mathfrak \mathit \mathrm \mathsf \mathtt \mathscr
+	\boldsymbol \bm \operatorname \operatorname* \text \textbf \textit \textrm \textsf
+	\texttt \mbox \displaystyle \textstyle \scriptstyle \scriptscriptstyle
+
+	\quad \qquad \enspace \thinspace \medspace \thickspace \negthinspace \hspace
+	\phantom \hphantom \vphantom \color
+
+	\begin \end \\ \{ \} \| \_ \& \% \# \$ \, \; \: \!
+`)
+
+// mathDropped are commands that are removed from math, they mean nothing to MathJax
+var mathDropped = setOf(`\nonumber \notag`)
+
+// setOf splits a list of words into a set
+func setOf(words string) map[string]bool {
+	set := map[string]bool{}
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+	return set
+}
+
+// Macros collects the command definitions of a parsed zettel that MathJax
+// can understand: \newcommand, \renewcommand, \providecommand and
+// \DeclareMathOperator.
+func Macros(root *sitter.Node, source []byte) map[string]Macro {
+	macros := map[string]Macro{}
+	collectMacros(root, source, macros)
+	return macros
+}
+
+func collectMacros(node *sitter.Node, source []byte, macros map[string]Macro) {
+	if node == nil {
+		return
+	}
+	if node.Type() != "new_command_definition" {
+		for i := 0; i < int(node.ChildCount()); i++ {
+			collectMacros(node.Child(i), source, macros)
+		}
+		return
+	}
+
+	command := node.ChildByFieldName("command")
+	declaration := node.ChildByFieldName("declaration")
+	implementation := node.ChildByFieldName("implementation")
+	if command == nil || declaration == nil || implementation == nil || implementation.Type() != "curly_group" {
+		return
+	}
+	if declaration.Type() == "curly_group_command_name" {
+		declaration = declaration.ChildByFieldName("command")
+		if declaration == nil {
+			return
+		}
+	}
+	name := declaration.Content(source)
+	body := implementation.Content(source)
+
+	var definition string
+	switch command.Content(source) {
+	case "\\newcommand", "\\newcommand*", "\\renewcommand", "\\renewcommand*",
+		"\\providecommand", "\\providecommand*":
+		definition = "\\newcommand{" + name + "}"
+		if argc := node.ChildByFieldName("argc"); argc != nil {
+			definition += argc.Content(source)
+		}
+		if def := node.ChildByFieldName("default"); def != nil {
+			definition += def.Content(source)
+		}
+		definition += body
+	case "\\DeclareMathOperator":
+		definition = "\\newcommand{" + name + "}{\\operatorname" + body + "}"
+	case "\\DeclareMathOperator*":
+		definition = "\\newcommand{" + name + "}{\\operatorname*" + body + "}"
+	default:
+		return
+	}
+
+	var uses []string
+	seen := map[string]bool{}
+	var walk func(n *sitter.Node)
+	walk = func(n *sitter.Node) {
+		if n.Type() == "command_name" || (!n.IsNamed() && strings.HasPrefix(n.Type(), "\\")) {
+			if use := n.Content(source); !seen[use] {
+				seen[use] = true
+				uses = append(uses, use)
+			}
+		}
+		for i := 0; i < int(n.ChildCount()); i++ {
+			walk(n.Child(i))
+		}
+	}
+	walk(implementation)
+
+	macros[name] = Macro{Definition: definition, Uses: uses}
+}
+
+// HTML translates a parsed card side into HTML for Anki. Math becomes \( \)
+// and \[ \] for Anki's MathJax, together with the definitions of the macros
+// it uses. Text commands and environments without an HTML equivalent, and
+// math with commands unknown to MathJax, yield an error wrapping ErrUntranslatable.
+func HTML(root *sitter.Node, source []byte, opts HTMLOptions) (string, error) {
+	h := htmlText{source: source, opts: opts, last: root.StartByte(), macros: map[string]bool{}}
+	h.walk(root)
+	if h.err != nil {
+		return "", h.err
+	}
+
+	out := strings.TrimSpace(h.out.String())
+	if len(h.macros) == 0 {
+		return out, nil
+	}
+
+	// MathJax keeps definitions for the whole page, they only need to come first
+	names := make([]string, 0, len(h.macros))
+	for name := range h.macros {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var definitions strings.Builder
+	for _, name := range names {
+		definitions.WriteString(html.EscapeString(opts.Macros[name].Definition))
+	}
+	return `<span style="display: none">\(` + definitions.String() + `\)</span>` + out, nil
+}
+
+// htmlText accumulates the HTML of a tree walk
+type htmlText struct {
+	source  []byte
+	opts    HTMLOptions
+	out     strings.Builder
+	pending int    // strongest separator requested since the last output
+	last    uint32 // end byte of the last emitted node
+	macros  map[string]bool
+	err     error
+}
+
+// fail records the first construct that cannot be translated
+func (h *htmlText) fail(what string) {
+	if h.err == nil {
+		h.err = fmt.Errorf("%w: %s", ErrUntranslatable, what)
+	}
+}
+
+// failNode records a node that cannot be translated
+func (h *htmlText) failNode(node *sitter.Node) {
+	snippet := strings.Join(strings.Fields(node.Content(h.source)), " ")
+	if len(snippet) > 40 {
+		snippet = snippet[:40] + "…"
+	}
+	h.fail(fmt.Sprintf("%s %q", node.Type(), snippet))
+}
+
+// separate requests a separator before the next output
+func (h *htmlText) separate(separator int) {
+	h.pending = max(h.pending, separator)
+}
+
+// emit writes HTML found at the given byte range, separated from the
+// previous output according to the whitespace in the source between them.
+func (h *htmlText) emit(text string, start, end uint32) {
+	if text == "" {
+		return
+	}
+
+	if start > h.last {
+		gap := string(h.source[h.last:start])
+		if blankLine.MatchString(gap) {
+			h.separate(separatorParagraph)
+		} else if strings.ContainsAny(gap, " \t\r\n") {
+			h.separate(separatorSpace)
+		}
+	}
+
+	if h.out.Len() > 0 {
+		switch h.pending {
+		case separatorSpace:
+			h.out.WriteString(" ")
+		case separatorLine:
+			h.out.WriteString("<br>")
+		case separatorParagraph:
+			h.out.WriteString("<br><br>")
+		}
+	}
+
+	h.out.WriteString(text)
+	h.pending = separatorNone
+	h.last = end
+}
+
+// block writes the tag of a block element, which needs no separator
+func (h *htmlText) block(tag string, end uint32) {
+	h.out.WriteString(tag)
+	h.pending = separatorNone
+	h.last = end
+}
+
+// close writes a closing tag right after the previous output
+func (h *htmlText) close(tag string, end uint32) {
+	h.out.WriteString("</" + tag + ">")
+	h.last = end
+}
+
+// walkChildren walks the children in [from, to)
+func (h *htmlText) walkChildren(node *sitter.Node, from, to int) {
+	for i := from; i < to && h.err == nil; i++ {
+		h.walk(node.Child(i))
+	}
+}
+
+func (h *htmlText) walk(node *sitter.Node) {
+	if node == nil || h.err != nil || htmlDroppedNodes[node.Type()] {
+		return
+	}
+	if node.IsError() || node.IsMissing() {
+		h.failNode(node)
+		return
+	}
+
+	count := int(node.ChildCount())
+	kind := node.Type()
+
+	switch {
+	case kind == "source_file" || kind == "text":
+		h.walkChildren(node, 0, count)
+
+	case kind == "inline_formula":
+		h.math(node, "\\(", "\\)", "")
+
+	case kind == "displayed_equation":
+		h.math(node, "\\[", "\\]", "")
+
+	case kind == "math_environment":
+		name := environmentName(node, h.source)
+		env, ok := displayMath[name]
+		if name == "math" {
+			h.math(node, "\\(", "\\)", "")
+		} else if ok {
+			h.math(node, "\\[", "\\]", env)
+		} else {
+			h.failNode(node)
+		}
+
+	case kind == "generic_environment":
+		tag, ok := htmlEnvironments[environmentName(node, h.source)]
+		if !ok {
+			h.failNode(node)
+			return
+		}
+		h.block("<"+tag+">", node.StartByte())
+		h.walkChildren(node, 0, count)
+		h.close(strings.Fields(tag)[0], node.EndByte())
+		h.pending = separatorNone
+
+	case kind == "begin" || kind == "end":
+		if node.ChildByFieldName("options") != nil {
+			h.failNode(node)
+		}
+
+	case kind == "enum_item":
+		h.block("<li>", node.StartByte())
+		for i := 0; i < count && h.err == nil; i++ {
+			switch node.FieldNameForChild(i) {
+			case "command":
+			case "label":
+				label := node.Child(i)
+				h.emit("<b>", label.StartByte(), label.StartByte())
+				h.walkChildren(label, 1, int(label.ChildCount())-1)
+				h.close("b", label.EndByte())
+			default:
+				h.walk(node.Child(i))
+			}
+		}
+		h.close("li", node.EndByte())
+		h.pending = separatorNone
+
+	case kind == "generic_command":
+		h.command(node)
+
+	case kind == "text_mode":
+		h.walk(node.ChildByFieldName("content"))
+
+	case kind == "hyperlink":
+		uri := node.ChildByFieldName("uri")
+		if uri == nil {
+			h.failNode(node)
+			return
+		}
+		href := html.EscapeString(strings.Trim(uri.Content(h.source), "{}"))
+		h.emit(`<a href="`+href+`">`, node.StartByte(), node.StartByte())
+		if label := node.ChildByFieldName("label"); label != nil {
+			h.walk(label)
+		} else {
+			h.emit(href, uri.StartByte(), uri.EndByte())
+		}
+		h.close("a", node.EndByte())
+
+	case strings.HasPrefix(kind, "curly_group"):
+		// skip the braces of the group
+		h.walkChildren(node, 1, count-1)
+
+	case kind == "brack_group" || kind == "brack_group_text":
+		h.walkChildren(node, 0, count)
+
+	case kind == "word":
+		text := html.EscapeString(quotes.Replace(node.Content(h.source)))
+		h.emit(strings.ReplaceAll(text, "~", "&nbsp;"), node.StartByte(), node.EndByte())
+
+	case kind == "operator" || kind == "delimiter":
+		h.emit(html.EscapeString(node.Content(h.source)), node.StartByte(), node.EndByte())
+
+	case count == 0 && !node.IsNamed():
+		// remaining leaves are punctuation or keywords of the nodes above
+		text := node.Content(h.source)
+		if !strings.HasPrefix(text, "\\") && text != "{" && text != "}" {
+			h.emit(html.EscapeString(text), node.StartByte(), node.EndByte())
+		}
+
+	default:
+		h.failNode(node)
+	}
+}
+
+// command translates a generic command: formatting commands become tags,
+// symbols their text, escaped characters are unescaped and layout commands
+// are dropped. Any other command fails the translation.
+func (h *htmlText) command(node *sitter.Node) {
+	nameNode := node.ChildByFieldName("command")
+	name := nameNode.Content(h.source)
+	count := int(node.ChildCount())
+
+	if tag, ok := htmlTags[name]; ok {
+		if count != 2 {
+			h.failNode(node)
+			return
+		}
+		if tag == "" {
+			h.walk(node.Child(1))
+			return
+		}
+		h.emit("<"+tag+">", node.StartByte(), nameNode.EndByte())
+		h.walk(node.Child(1))
+		h.close(tag, node.EndByte())
+		return
+	}
+
+	switch {
+	case name == "\\\\" || name == "\\newline" || name == "\\linebreak":
+		h.separate(separatorLine)
+	case name == "\\par":
+		h.separate(separatorParagraph)
+	case LayoutCommands[name]:
+	case len(name) == 2 && strings.ContainsAny(name[1:], "%&_#${}"):
+		h.emit(html.EscapeString(name[1:]), node.StartByte(), nameNode.EndByte())
+	case htmlSymbols[name] != "" || name == "\\!":
+		h.emit(htmlSymbols[name], node.StartByte(), nameNode.EndByte())
+		// arguments of symbols are empty groups like in \ldots{}
+		for i := 1; i < count; i++ {
+			if node.Child(i).Content(h.source) != "{}" {
+				h.failNode(node)
+			}
+		}
+	default:
+		h.failNode(node)
+	}
+	h.last = node.EndByte()
+}
+
+// math emits a formula between the MathJax delimiters, optionally wrapped
+// into a math environment. The formula is checked for commands MathJax does
+// not know.
+func (h *htmlText) math(node *sitter.Node, open, close, env string) {
+	count := int(node.ChildCount())
+	if count < 2 || node.HasError() {
+		h.failNode(node)
+		return
+	}
+	start, end := node.Child(0).EndByte(), node.Child(count-1).StartByte()
+
+	var tex strings.Builder
+	pos := start
+	var walk func(n *sitter.Node)
+	walk = func(n *sitter.Node) {
+		if h.err != nil || n.EndByte() <= start || n.StartByte() >= end {
+			return
+		}
+		if n.IsError() || n.IsMissing() {
+			h.failNode(n)
+			return
+		}
+
+		kind := n.Type()
+		dropped := kind == "label_definition" || kind == "line_comment" || kind == "block_comment"
+		if kind == "generic_command" {
+			dropped = mathDropped[n.ChildByFieldName("command").Content(h.source)]
+		}
+		if dropped {
+			tex.Write(h.source[pos:n.StartByte()])
+			pos = n.EndByte()
+			return
+		}
+
+		if kind == "math_environment" || kind == "generic_environment" {
+			if name := environmentName(n, h.source); !mathEnvironments[name] {
+				h.fail(fmt.Sprintf("math environment %s", name))
+				return
+			}
+		}
+		if kind == "command_name" || (!n.IsNamed() && strings.HasPrefix(kind, "\\")) {
+			h.mathCommand(n.Content(h.source))
+		}
+
+		for i := 0; i < int(n.ChildCount()); i++ {
+			walk(n.Child(i))
+		}
+	}
+	for i := 1; i < count-1; i++ {
+		walk(node.Child(i))
+	}
+	tex.Write(h.source[pos:end])
+	if h.err != nil {
+		return
+	}
+
+	formula := strings.TrimSpace(tex.String())
+	if env != "" {
+		formula = "\\begin{" + env + "}" + formula + "\\end{" + env + "}"
+	}
+	h.emit(open+html.EscapeString(formula)+close, node.StartByte(), node.EndByte())
+}
+
+// mathCommand checks that MathJax knows a command or that it is a macro
+// defined in the zettel using only commands MathJax knows
+func (h *htmlText) mathCommand(name string) {
+	// the control space cannot be listed in mathCommands
+	if mathCommands[name] || h.macros[name] || name == "\\ " {
+		return
+	}
+	macro, ok := h.opts.Macros[name]
+	if !ok {
+		h.fail(fmt.Sprintf("command %s in math", name))
+		return
+	}
+	h.macros[name] = true
+	for _, use := range macro.Uses {
+		h.mathCommand(use)
+	}
+}
+
+// environmentName returns the name of an environment, e.g. itemize
+func environmentName(node *sitter.Node, source []byte) string {
+	begin := node.ChildByFieldName("begin")
+	if begin == nil {
+		return ""
+	}
+	name := begin.ChildByFieldName("name")
+	if name == nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.Trim(name.Content(source), "{}"))
+}
@@ -0,0 +1,335 @@
+package treesitter
+
+import (
+	"os"
+	"regexp"
+	"strings"
+
+	sitter "github.com/smacker/go-tree-sitter"
+)
+
+// PlainTextOptions configures PlainText
+type PlainTextOptions struct {
+	KeepMath bool // keep math as TeX source (e.g. $x^2$) instead of dropping it
+}
+
+// droppedNodes are left out of the plain text together with their arguments
+var droppedNodes = map[string]bool{
+	"line_comment":                true,
+	"block_comment":               true,
+	"comment_environment":         true,
+	"verbatim_environment":        true,
+	"listing_environment":         true,
+	"minted_environment":          true,
+	"label_definition":            true,
+	"label_reference":             true,
+	"label_reference_range":       true,
+	"label_number":                true,
+	"citation":                    true,
+	"package_include":             true,
+	"class_include":               true,
+	"latex_include":               true,
+	"import_include":              true,
+	"graphics_include":            true,
+	"svg_include":                 true,
+	"inkscape_include":            true,
+	"verbatim_include":            true,
+	"biblatex_include":            true,
+	"bibstyle_include":            true,
+	"bibtex_include":              true,
+	"new_command_definition":      true,
+	"old_command_definition":      true,
+	"let_command_definition":      true,
+	"paired_delimiter_definition": true,
+	"environment_definition":      true,
+	"theorem_definition":          true,
+	"color_definition":            true,
+	"color_set_definition":        true,
+	"tikz_library_import":         true,
+}
+
+// LayoutCommands are generic commands that only affect the layout.
+// They are dropped together with their arguments, while the arguments of
+// all other commands (e.g. \textbf or \emph) are kept. Macros of the kasten
+// are added with LAYOUT_COMMANDS.
+var LayoutCommands = withLayoutCommands(map[string]bool{
+	"\\vspace": true, "\\vspace*": true, "\\hspace": true, "\\hspace*": true,
+	"\\vfill": true, "\\hfill": true, "\\newline": true, "\\linebreak": true,
+	"\\newpage": true, "\\clearpage": true, "\\pagebreak": true, "\\noindent": true,
+	"\\indent": true, "\\centering": true, "\\smallskip": true, "\\medskip": true,
+	"\\bigskip": true, "\\maketitle": true, "\\tableofcontents": true,
+	"\\printbibliography": true, "\\hline": true, "\\toprule": true,
+	"\\midrule": true, "\\bottomrule": true, "\\setlength": true,
+	"\\pagestyle": true, "\\thispagestyle": true,
+}, os.Getenv("LAYOUT_COMMANDS"))
+
+// withLayoutCommands adds the configured macros (separated by spaces or
+// commas, with or without backslash) to the default layout commands
+func withLayoutCommands(commands map[string]bool, configured string) map[string]bool {
+	names := strings.FieldsFunc(configured, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for _, name := range names {
+		commands["\\"+strings.TrimPrefix(name, "\\")] = true
+	}
+	return commands
+}
+
+// sectioningNodes start a new paragraph and end their heading with one
+var sectioningNodes = map[string]bool{
+	"part": true, "chapter": true, "section": true, "subsection": true,
+	"subsubsection": true, "paragraph": true, "subparagraph": true,
+}
+
+// separators in increasing strength
+const (
+	separatorNone = iota
+	separatorSpace
+	separatorLine
+	separatorParagraph
+)
+
+var blankLine = regexp.MustCompile(`\n[ \t\r]*\n`)
+
+// FindDocument returns the document environment of a parsed zettel, or nil if there is none.
+func FindDocument(root *sitter.Node, source []byte) *sitter.Node {
+	documentEnv := FindGenericEnvironment(root, source, "document")
+	if len(documentEnv) == 0 {
+		return nil
+	}
+	return documentEnv[0].EnvironmentNode
+}
+
+// titleNodes carry the title of a zettel in their text field
+var titleNodes = map[string]bool{
+	"title_declaration": true, "part": true, "chapter": true, "section": true,
+	"subsection": true, "subsubsection": true, "paragraph": true, "subparagraph": true,
+}
+
+// FindTitle returns the text argument of the first \title or heading in document order, or nil.
+func FindTitle(node *sitter.Node) *sitter.Node {
+	if titleNodes[node.Type()] {
+		if text := node.ChildByFieldName("text"); text != nil {
+			return text
+		}
+	}
+	for i := 0; i < int(node.ChildCount()); i++ {
+		if title := FindTitle(node.Child(i)); title != nil {
+			return title
+		}
+	}
+	return nil
+}
+
+// Title returns the plain text title of a zettel, or "" if it has neither \title nor a heading.
+func Title(root *sitter.Node, source []byte) string {
+	title := FindTitle(root)
+	if title == nil {
+		return ""
+	}
+	return PlainTextNode(title, source, PlainTextOptions{KeepMath: true})
+}
+
+// PlainText returns the readable text of the document body of a parsed zettel.
+// Comments and layout commands are dropped, the arguments of text formatting
+// commands are kept and environments are rendered as paragraphs.
+// If there is no document environment the whole tree is rendered.
+func PlainText(root *sitter.Node, source []byte, opts PlainTextOptions) string {
+	body := FindDocument(root, source)
+	if body == nil {
+		body = root
+	}
+	return PlainTextNode(body, source, opts)
+}
+
+// PlainTextNode renders any node of a syntax tree as plain text.
+func PlainTextNode(node *sitter.Node, source []byte, opts PlainTextOptions) string {
+	return PlainTextRange(node, source, node.StartByte(), node.EndByte(), opts)
+}
+
+// PlainTextRange renders the part of a syntax tree between two byte offsets
+// as plain text. Words reaching into the range are kept whole.
+func PlainTextRange(node *sitter.Node, source []byte, start, end uint32, opts PlainTextOptions) string {
+	p := plainText{source: source, opts: opts, last: start, start: start, end: end}
+	p.walk(node)
+
+	lines := strings.Split(p.out.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// plainText accumulates the text of a tree walk
+type plainText struct {
+	source  []byte
+	opts    PlainTextOptions
+	out     strings.Builder
+	pending int    // strongest separator requested since the last output
+	last    uint32 // end byte of the last emitted node
+	start   uint32 // byte range to render, nodes outside of it are skipped
+	end     uint32
+}
+
+// separate requests a separator before the next output
+func (p *plainText) separate(separator int) {
+	p.pending = max(p.pending, separator)
+}
+
+// emit writes text found at the given byte range, separated from the previous
+// output according to the whitespace in the source between them.
+func (p *plainText) emit(text string, start, end uint32) {
+	if text == "" {
+		return
+	}
+
+	if start > p.last {
+		gap := string(p.source[p.last:start])
+		if blankLine.MatchString(gap) {
+			p.separate(separatorParagraph)
+		} else if strings.ContainsAny(gap, " \t\r\n") {
+			p.separate(separatorSpace)
+		}
+	}
+
+	if p.out.Len() > 0 {
+		switch p.pending {
+		case separatorSpace:
+			p.out.WriteString(" ")
+		case separatorLine:
+			p.out.WriteString("\n")
+		case separatorParagraph:
+			p.out.WriteString("\n\n")
+		}
+	}
+
+	p.out.WriteString(text)
+	p.pending = separatorNone
+	p.last = end
+}
+
+// raw emits the source of a node unchanged
+func (p *plainText) raw(node *sitter.Node) {
+	text := strings.Join(strings.Fields(node.Content(p.source)), " ")
+	p.emit(text, node.StartByte(), node.EndByte())
+}
+
+// walkChildren walks the children in [from, to)
+func (p *plainText) walkChildren(node *sitter.Node, from, to int) {
+	for i := from; i < to; i++ {
+		p.walk(node.Child(i))
+	}
+}
+
+func (p *plainText) walk(node *sitter.Node) {
+	if node == nil || droppedNodes[node.Type()] {
+		return
+	}
+	if node.EndByte() <= p.start || node.StartByte() >= p.end {
+		return
+	}
+
+	count := int(node.ChildCount())
+	kind := node.Type()
+
+	switch {
+	case kind == "inline_formula":
+		if p.opts.KeepMath {
+			p.raw(node)
+		}
+
+	case kind == "displayed_equation" || kind == "math_environment":
+		p.separate(separatorParagraph)
+		if p.opts.KeepMath {
+			p.raw(node)
+			p.separate(separatorParagraph)
+		}
+
+	case kind == "generic_environment":
+		p.separate(separatorParagraph)
+		p.walkChildren(node, 0, count)
+		p.separate(separatorParagraph)
+
+	case kind == "begin":
+		// keep the optional title, e.g. \begin{theorem}[Pythagoras]
+		if options := node.ChildByFieldName("options"); options != nil {
+			p.walk(options)
+			p.separate(separatorLine)
+		}
+
+	case kind == "end":
+
+	case sectioningNodes[kind]:
+		p.separate(separatorParagraph)
+		for i := 0; i < count; i++ {
+			switch node.FieldNameForChild(i) {
+			case "toc":
+			case "text":
+				p.walk(node.Child(i))
+				p.separate(separatorParagraph)
+			default:
+				p.walk(node.Child(i))
+			}
+		}
+
+	case kind == "enum_item":
+		p.separate(separatorLine)
+		p.walkChildren(node, 0, count)
+
+	case kind == "generic_command":
+		p.command(node)
+
+	case kind == "hyperlink":
+		if label := node.ChildByFieldName("label"); label != nil {
+			p.walk(label)
+		} else if uri := node.ChildByFieldName("uri"); uri != nil {
+			p.walkChildren(uri, 1, int(uri.ChildCount())-1)
+		}
+
+	case strings.HasPrefix(kind, "curly_group") || strings.HasPrefix(kind, "brack_group"):
+		// skip the brackets of the group
+		p.walkChildren(node, 1, count-1)
+
+	case kind == "word":
+		text := strings.ReplaceAll(node.Content(p.source), "~", " ")
+		p.emit(text, node.StartByte(), node.EndByte())
+
+	case kind == "operator" || kind == "delimiter" || kind == "letter" ||
+		kind == "subscript" || kind == "superscript":
+		p.raw(node)
+
+	case count == 0:
+		// remaining leaves are punctuation or keywords like \section and \item
+		text := node.Content(p.source)
+		if !node.IsNamed() && !strings.HasPrefix(text, "\\") &&
+			text != "{" && text != "}" && text != "$" && text != "$$" {
+			p.emit(text, node.StartByte(), node.EndByte())
+		}
+
+	default:
+		p.walkChildren(node, 0, count)
+	}
+}
+
+// command renders a generic command: layout commands are dropped, escaped
+// characters are unescaped and the arguments of all other commands are kept.
+func (p *plainText) command(node *sitter.Node) {
+	name := node.Child(0).Content(p.source)
+
+	switch {
+	case LayoutCommands[name]:
+		return
+	case name == "\\\\" || name == "\\par":
+		p.separate(separatorLine)
+		if name == "\\par" {
+			p.separate(separatorParagraph)
+		}
+		return
+	case len(name) == 2 && strings.ContainsAny(name[1:], "%&_#${}"):
+		p.emit(name[1:], node.StartByte(), node.Child(0).EndByte())
+	case len(name) == 2 && strings.ContainsAny(name[1:], " ,;:!"):
+		p.separate(separatorSpace)
+	}
+
+	p.walkChildren(node, 1, int(node.ChildCount()))
+}
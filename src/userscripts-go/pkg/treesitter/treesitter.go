@@ -135,3 +135,24 @@ func FindGenericEnvironment(
 
 	return foundEnvironments
 }
+
+// FindErrors collects the ERROR and MISSING nodes of a syntax tree.
+func FindErrors(node *sitter.Node) []*sitter.Node {
+	var errors []*sitter.Node
+
+	if node == nil || !node.HasError() && !node.IsMissing() {
+		return errors
+	}
+
+	// Nested errors inside an ERROR node are not reported separately
+	if node.IsError() || node.IsMissing() {
+		return append(errors, node)
+	}
+
+	// Recursively search through each child node
+	for i := 0; i < int(node.ChildCount()); i++ {
+		errors = append(errors, FindErrors(node.Child(i))...)
+	}
+
+	return errors
+}